@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// getModuleInfo returns info for the module containing dir in the form of
+// package info for its root import path, for use with -all-packages where
+// the module root need not be a package itself.
+func getModuleInfo(dir string, flags []string) (*packageInfo, error) {
+	info := new(packageInfo)
+	args := append([]string{"list", "-m", "-json"}, flags...)
+	if err := execInDirAndParseJSON(dir, &info.Module, goBin, args...); err != nil {
+		return nil, err
+	}
+	if info.Module.Path == "" {
+		return nil, errors.New("source is not within a module")
+	}
+	info.ImportPath = info.Module.Path
+	info.Dir = info.Module.Dir
+	return info, nil
+}
+
+// listPackages lists every package matching the pattern (e.g. ./... for
+// every package beneath dir) with go list, which prints one JSON object per
+// package. The objects are decoded as go list writes them.
+func listPackages(dir, pattern string, flags, env []string) ([]*packageInfo, error) {
+	args := append([]string{"list", "-json"}, flags...)
+	args = append(args, pattern)
+	cmd := exec.Command(goBin, args...)
+	cmd.Dir = dir
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	var infos []*packageInfo
+	err := runAndDecodeJSON(cmd, func(decoder *json.Decoder) error {
+		for {
+			info := new(packageInfo)
+			if err := decoder.Decode(info); errors.Is(err, io.EOF) {
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("failed to unmarshal package info: %w", err)
+			}
+			infos = append(infos, info)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// addModulePackages adds the listed packages, each placed at its path
+// relative to the base import path (the source module for -all-packages, or
+// the root of a -src-pkg pattern) within the destination.
+func (w *Work) addModulePackages(infos []*packageInfo, base string, opts *Options) error {
+	for _, info := range infos {
+		if _, ok := w.Mappings[info.ImportPath]; ok {
+			return fmt.Errorf("cannot map package %q: every listed package keeps its place relative to %q", info.ImportPath, base)
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(info.ImportPath, base), "/")
+		dstPkg := path.Join(w.DstModule, rel)
+		dstDir := filepath.Join(w.DstDir, filepath.FromSlash(rel))
+
+		logger.Debug("Adding module package", "pkg", info.ImportPath, "src", info.Dir, "dst", dstDir)
+		w.addPackage(info, dstPkg, dstDir)
+		w.addPackageReplacement(info.ImportPath, dstPkg)
+		logDroppedPlatformFiles(info, opts.OnlyPlatform)
+		files, testdata, err := info.filesToCopy(opts.Tests, opts.OnlyPlatform != "", opts.IgnoreTagged, opts.PreserveSymlinks)
+		if err != nil {
+			return err
+		}
+		if err := w.addCopies(info.Dir, dstDir, files, testdata); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// srcPkgPattern returns the root import path of a -src-pkg pattern matching
+// every package beneath it (e.g. example.com/mod/plugins for
+// example.com/mod/plugins/...), or false if it is not such a pattern.
+func srcPkgPattern(srcPkg string) (string, bool) {
+	return strings.CutSuffix(srcPkg, "/...")
+}
+
+// resolveSrcPattern locates the directory of the root of a -src-pkg pattern
+// as seen from the current directory, from the packages it matches.
+func resolveSrcPattern(pattern, root string) (string, error) {
+	infos, err := listPackages(".", pattern, nil, nil)
+	switch {
+	case err != nil:
+		return "", fmt.Errorf("failed to resolve source packages %q (is the module required by the current module and downloaded?): %w", pattern, err)
+	case len(infos) == 0:
+		return "", fmt.Errorf("no source packages match %q", pattern)
+	}
+	rel := strings.TrimPrefix(strings.TrimPrefix(infos[0].ImportPath, root), "/")
+	dir := infos[0].Dir
+	for i := strings.Count(rel, "/") + 1; rel != "" && i > 0; i-- {
+		dir = filepath.Dir(dir)
+	}
+	logger.Debug("Resolved source package pattern", "pattern", pattern, "src", dir)
+	return dir, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"go/build"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// unbuildableFiles returns the copied Go files whose file name or build
+// constraints exclude them from the destination build context: the platform
+// of -only-platform (or the current platform) with the build tags given in
+// -golist-flags.
+func (w *Work) unbuildableFiles(platform, goListFlags string) ([]string, error) {
+	ctxt := build.Default
+	ctxt.GOOS, ctxt.GOARCH = runtime.GOOS, runtime.GOARCH
+	if goos, goarch, ok := strings.Cut(platform, "/"); ok {
+		ctxt.GOOS, ctxt.GOARCH = goos, goarch
+	}
+	ctxt.BuildTags = goListTags(goListFlags)
+
+	var unbuildable []string
+	for _, src := range sortedKeys(w.GoFiles) {
+		ok, err := ctxt.MatchFile(filepath.Dir(src), filepath.Base(src))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			unbuildable = append(unbuildable, src)
+		}
+	}
+	return unbuildable, nil
+}
+
+// goListTags returns the build tags given by a -tags flag in the go list
+// flags, which may be separated by commas or (historically) spaces.
+func goListTags(goListFlags string) []string {
+	fields := strings.Fields(goListFlags)
+	for i, flag := range fields {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(flag, "-"), "=")
+		if name != "tags" {
+			continue
+		}
+		if !hasValue && i+1 < len(fields) {
+			value = fields[i+1]
+		}
+		return strings.FieldsFunc(value, func(r rune) bool {
+			return r == ','
+		})
+	}
+	return nil
+}
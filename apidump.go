@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/zeebo/errs"
+)
+
+// apiDump writes the exported API of the top source package to path, one
+// declaration per line, and warns about each line of it the transplanted
+// package does not declare identically. Types from other packages are
+// qualified by their destination import path, so the source and destination
+// APIs are directly comparable even when dependencies are renamed or
+// flattened.
+func apiDump(work *Work, path string, strict bool) error {
+	pkg := work.findPackage(work.SrcImportPath)
+	if pkg == nil {
+		return fmt.Errorf("cannot dump the API of %q: it is not transplanted", work.SrcImportPath)
+	}
+
+	pkgDir, err := filepath.Abs(pkg.SrcDir)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	var srcFiles, dstFiles []string
+	for _, src := range sortedKeys(work.GoFiles) {
+		absSrc, err := filepath.Abs(src)
+		if err != nil {
+			return errs.Wrap(err)
+		}
+		absDst, err := filepath.Abs(work.GoFiles[src])
+		if err != nil {
+			return errs.Wrap(err)
+		}
+		if filepath.Dir(absSrc) == pkgDir && !strings.HasSuffix(src, "_test.go") {
+			srcFiles = append(srcFiles, absSrc)
+			dstFiles = append(dstFiles, absDst)
+		}
+	}
+
+	logger.Info("Dumping source API...", "path", path)
+	srcAPI, err := packageAPI(pkg.SrcDir, srcFiles, work.packagePaths())
+	if err != nil {
+		return fmt.Errorf("failed to load the API of the source package: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(srcAPI, "\n")+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write API dump: %w", err)
+	}
+
+	dstAPI, err := packageAPI(pkg.DstDir, dstFiles, nil)
+	if err != nil {
+		return fmt.Errorf("failed to load the API of the destination package: %w", err)
+	}
+	declared := make(map[string]bool)
+	for _, line := range dstAPI {
+		declared[line] = true
+	}
+	for _, line := range srcAPI {
+		if !declared[line] {
+			if err := warn(strict, "Exported API of the source package is missing or changed in the destination", "decl", line); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// packageAPI type-checks the package in dir made up of the Go files (those
+// not buildable for the current platform are left out) and returns its
+// exported declarations in sorted order, qualifying other packages by their
+// import path as mapped by paths, if present. Cgo is not run; the types from
+// "C" are left unchecked.
+func packageAPI(dir string, files []string, paths map[string]string) ([]string, error) {
+	fset := token.NewFileSet()
+	var parsed []*ast.File
+	for _, file := range files {
+		if ok, err := build.Default.MatchFile(filepath.Dir(file), filepath.Base(file)); err != nil || !ok {
+			continue
+		}
+		f, err := parser.ParseFile(fset, file, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, f)
+	}
+	if len(parsed) == 0 {
+		return nil, nil
+	}
+
+	exports, err := exportData(dir)
+	if err != nil {
+		return nil, err
+	}
+	lookup := func(importPath string) (io.ReadCloser, error) {
+		file, ok := exports[importPath]
+		if !ok {
+			return nil, fmt.Errorf("no export data for %q", importPath)
+		}
+		return os.Open(file)
+	}
+
+	conf := types.Config{Importer: importer.ForCompiler(fset, "gc", lookup), FakeImportC: true}
+	pkg, err := conf.Check(parsed[0].Name.Name, fset, parsed, nil)
+	if err != nil {
+		return nil, err
+	}
+	qualifier := func(other *types.Package) string {
+		if other == pkg {
+			return ""
+		}
+		if path, ok := paths[other.Path()]; ok {
+			return path
+		}
+		return other.Path()
+	}
+
+	var api []string
+	scope := pkg.Scope()
+	for _, name := range scope.Names() {
+		obj := scope.Lookup(name)
+		if !obj.Exported() {
+			continue
+		}
+		api = append(api, types.ObjectString(obj, qualifier))
+
+		named, ok := obj.Type().(*types.Named)
+		if !ok || !isTypeName(obj) {
+			continue
+		}
+		for i := 0; i < named.NumMethods(); i++ {
+			if method := named.Method(i); method.Exported() {
+				api = append(api, types.ObjectString(method, qualifier))
+			}
+		}
+	}
+	sort.Strings(api)
+	return api, nil
+}
+
+// exportData builds the dependencies of the package in dir and returns the
+// paths of their export data files keyed by import path.
+func exportData(dir string) (map[string]string, error) {
+	out, err := execInDirOutput(dir, goBin, "list", "-export", "-deps", "-f", "{{.ImportPath}}\t{{.Export}}", ".")
+	if err != nil {
+		return nil, fmt.Errorf("failed to build dependencies: %w", err)
+	}
+	exports := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		if importPath, file, ok := strings.Cut(line, "\t"); ok && file != "" {
+			exports[importPath] = file
+		}
+	}
+	return exports, nil
+}
+
+func isTypeName(obj types.Object) bool {
+	_, ok := obj.(*types.TypeName)
+	return ok
+}
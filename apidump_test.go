@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAPIDumpComparesByDestinationImportPath(t *testing.T) {
+	srcDir := newModule(t, "example.com/old", map[string]string{
+		"b/b.go":         "package b\n\nimport \"example.com/old/types\"\n\nfunc New() types.T { return types.T{} }\n",
+		"types/types.go": "package types\n\ntype T struct{}\n",
+	})
+
+	for name, configure := range map[string]func(*Options){
+		"renamed": func(opts *Options) {
+			opts.PackageRenames = []string{"example.com/old/types=kinds"}
+		},
+		"flattened": func(opts *Options) {
+			opts.FlattenDeps = true
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dstDir := newModule(t, "example.com/new", nil)
+			opts := testOptions()
+			opts.Strict = true
+			opts.APIDump = filepath.Join(t.TempDir(), "api.txt")
+			configure(opts)
+			if _, err := transplantForTest(t, dstDir, filepath.Join(srcDir, "b"), opts); err != nil {
+				t.Fatal(err)
+			}
+			if got := readFile(t, opts.APIDump); !strings.Contains(got, "example.com/new/internal/") {
+				t.Errorf("expected the dump to qualify types by destination import path:\n%s", got)
+			}
+		})
+	}
+}
+
+func TestAPIDumpCgoPackage(t *testing.T) {
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc is not available")
+	}
+	srcDir := newModule(t, "example.com/old", map[string]string{
+		"foo.go": "package foo\n\n// int one() { return 1; }\nimport \"C\"\n\nfunc One() int { return int(C.one()) }\n",
+	})
+	dstDir := newModule(t, "example.com/new", nil)
+
+	opts := testOptions()
+	opts.Strict = true
+	opts.APIDump = filepath.Join(t.TempDir(), "api.txt")
+	if _, err := transplantForTest(t, dstDir, srcDir, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, opts.APIDump); got != "func One() int\n" {
+		t.Errorf("got API dump %q", got)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/zeebo/errs"
+)
+
+// BatchItem is a single transplant read by -stdin. Either Src (a source
+// directory) or SrcPkg (a source import path, resolved as with -src-pkg) is
+// required, along with Dst. DstModule, if set, overrides -dst-module.
+type BatchItem struct {
+	Src       string `json:"src,omitempty"`
+	SrcPkg    string `json:"srcPkg,omitempty"`
+	Dst       string `json:"dst"`
+	DstModule string `json:"dstModule,omitempty"`
+}
+
+// readBatch reads the transplants for -stdin, one per line, each either a
+// JSON BatchItem or a source import path and destination directory separated
+// by whitespace. Blank lines and lines starting with # are ignored.
+func readBatch(r io.Reader) ([]BatchItem, error) {
+	var items []BatchItem
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		var item BatchItem
+		if strings.HasPrefix(text, "{") {
+			decoder := json.NewDecoder(strings.NewReader(text))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&item); err != nil {
+				return nil, fmt.Errorf("line %d: failed to unmarshal batch item: %w", line, err)
+			}
+		} else {
+			fields := strings.Fields(text)
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: expected IMPORTPATH DSTDIR or a JSON object", line)
+			}
+			item = BatchItem{SrcPkg: fields[0], Dst: fields[1]}
+		}
+		switch {
+		case item.Dst == "":
+			return nil, fmt.Errorf("line %d: missing destination directory", line)
+		case (item.Src == "") == (item.SrcPkg == ""):
+			return nil, fmt.Errorf("line %d: exactly one of src and srcPkg is required", line)
+		}
+		items = append(items, item)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errs.Wrap(err)
+	}
+	return items, nil
+}
+
+// batch runs each transplant read from r for -stdin as an independent run
+// with the rest of the options. A failed transplant does not stop the rest;
+// the status of each is logged once all have run, and it is an error if any
+// failed.
+func batch(r io.Reader, opts *Options) error {
+	items, err := readBatch(r)
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		return errors.New("no transplants read from stdin")
+	}
+
+	failures := make([]error, len(items))
+	for i, item := range items {
+		itemOpts := *opts
+		itemOpts.SrcPkg = item.SrcPkg
+		if item.DstModule != "" {
+			itemOpts.DstModule = item.DstModule
+		}
+		logger.Info("Running batch transplant...", "item", i+1, "of", len(items), "dst", item.Dst)
+		failures[i] = run(item.Dst, item.Src, &itemOpts)
+		if failures[i] != nil {
+			logger.Error("Batch transplant failed", "item", i+1, "dst", item.Dst, "err", failures[i])
+		}
+	}
+
+	failed := 0
+	for i, item := range items {
+		src := item.Src
+		if src == "" {
+			src = item.SrcPkg
+		}
+		if failures[i] != nil {
+			failed++
+			logger.Info("Batch result", "item", i+1, "src", src, "dst", item.Dst, "status", "failed", "err", failures[i])
+			continue
+		}
+		logger.Info("Batch result", "item", i+1, "src", src, "dst", item.Dst, "status", "ok")
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d batch transplants failed", failed, len(items))
+	}
+	return nil
+}
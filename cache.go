@@ -0,0 +1,56 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/zeebo/errs"
+)
+
+// packageInfoCache memoizes package info by absolute directory, pattern, and
+// flags. It is safe for concurrent use; concurrent lookups of the same key
+// share a single go list invocation. Every lookup is listed with the same
+// additional environment (e.g. GOOS and GOARCH).
+type packageInfoCache struct {
+	env []string
+
+	mu      sync.Mutex
+	entries map[string]*packageInfoEntry
+}
+
+type packageInfoEntry struct {
+	once sync.Once
+	info *packageInfo
+	err  error
+}
+
+func newPackageInfoCache(env []string) *packageInfoCache {
+	return &packageInfoCache{
+		env:     env,
+		entries: make(map[string]*packageInfoEntry),
+	}
+}
+
+// get returns the package info for the pattern as resolved from dir, listing
+// it with go list the first time it is requested.
+func (c *packageInfoCache) get(dir, pattern string, flags []string) (*packageInfo, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	key := strings.Join(append([]string{absDir, pattern}, flags...), "\x00")
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if !ok {
+		entry = new(packageInfoEntry)
+		c.entries[key] = entry
+	}
+	c.mu.Unlock()
+
+	entry.once.Do(func() {
+		entry.info, entry.err = getPackageInfo(absDir, pattern, flags, c.env)
+	})
+	return entry.info, entry.err
+}
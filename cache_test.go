@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPackageInfoCacheListsOncePerDir(t *testing.T) {
+	srcDir := newModule(t, "example.com/old", map[string]string{
+		"foo.go":       "package foo\n",
+		"util/util.go": "package util\n",
+	})
+
+	var lists atomic.Int32
+	execObserver = func(cmd []string, dir string, dur time.Duration, err error) {
+		if len(cmd) > 1 && cmd[1] == "list" {
+			lists.Add(1)
+		}
+	}
+	t.Cleanup(func() { execObserver = nil })
+
+	cache := newPackageInfoCache(nil)
+	infos := make([]*packageInfo, 8)
+	errs := make([]error, len(infos))
+	var wg sync.WaitGroup
+	for i := range infos {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			infos[i], errs[i] = cache.get(srcDir, ".", nil)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range infos {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if infos[i] != infos[0] {
+			t.Errorf("lookup %d returned different package info", i)
+		}
+	}
+	if infos[0].ImportPath != "example.com/old" {
+		t.Errorf("got import path %q, want example.com/old", infos[0].ImportPath)
+	}
+	if got := lists.Load(); got != 1 {
+		t.Errorf("got %d go list invocations, want 1", got)
+	}
+
+	if _, err := cache.get(srcDir, "./util", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.get(srcDir, "./util", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := lists.Load(); got != 2 {
+		t.Errorf("got %d go list invocations after listing another package twice, want 2", got)
+	}
+}
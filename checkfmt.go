@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/zeebo/errs"
+)
+
+// unformattedGoFiles returns the destination Go files of the work that are
+// not gofmt-clean, like gofmt -l would. Line endings are ignored, since they
+// are chosen by -eol. With keepImportOrder, as for -prefer-source-order,
+// unsorted imports are not counted as unformatted.
+func (w *Work) unformattedGoFiles(keepImportOrder bool) ([]string, error) {
+	formatSource := format.Source
+	if keepImportOrder {
+		formatSource = formatKeepingImportOrder
+	}
+
+	var files []string
+	for _, dst := range w.GoFiles {
+		files = append(files, dst)
+	}
+	for dst := range w.GeneratedFiles {
+		if filepath.Ext(dst) == ".go" {
+			files = append(files, dst)
+		}
+	}
+	sort.Strings(files)
+
+	var unformatted []string
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, errs.Wrap(err)
+		}
+		data = normalizeEOL(data, eolLF)
+		formatted, err := formatSource(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to format %q: %w", file, err)
+		}
+		if !bytes.Equal(data, formatted) {
+			unformatted = append(unformatted, file)
+		}
+	}
+	return unformatted, nil
+}
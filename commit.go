@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// commitFlag sets Options.Commit, and Options.CommitMessage if a message is
+// given in place of true.
+type commitFlag Options
+
+func (f *commitFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	if f.CommitMessage != "" {
+		return f.CommitMessage
+	}
+	return strconv.FormatBool(f.Commit)
+}
+
+func (f *commitFlag) Set(value string) error {
+	if b, err := strconv.ParseBool(value); err == nil {
+		f.Commit = b
+		return nil
+	}
+	if value == "" {
+		return errors.New("expected true, false, or a commit message")
+	}
+	f.Commit = true
+	f.CommitMessage = value
+	return nil
+}
+
+func (f *commitFlag) IsBoolFlag() bool {
+	return true
+}
+
+// prepareCommit ensures the destination is within a git repository with no
+// uncommitted changes (unless -commit-allow-dirty is set) and, with -branch,
+// switches to the branch, creating it from HEAD if it does not exist, before
+// anything is written.
+func prepareCommit(dstDir string, opts *Options) error {
+	status, err := execInDirOutput(dstDir, "git", "status", "--porcelain", "--", ".")
+	if err != nil {
+		return fmt.Errorf("-commit requires the destination to be within a git repository: %w", err)
+	}
+	if strings.TrimSpace(status) != "" && !opts.CommitAllowDirty {
+		return errors.New("destination has uncommitted changes; commit or stash them, or use -commit-allow-dirty")
+	}
+	if opts.Branch == "" {
+		return nil
+	}
+
+	if _, err := execInDirOutput(dstDir, "git", "rev-parse", "--verify", "--quiet", "refs/heads/"+opts.Branch); err == nil {
+		logger.Info("Switching to branch...", "branch", opts.Branch)
+		if output, err := execInDirCombinedOutput(dstDir, "git", "switch", opts.Branch); err != nil {
+			return fmt.Errorf("failed to switch to branch %q: %w: %s", opts.Branch, err, output)
+		}
+		return nil
+	}
+	logger.Info("Creating branch...", "branch", opts.Branch)
+	if output, err := execInDirCombinedOutput(dstDir, "git", "switch", "-c", opts.Branch); err != nil {
+		return fmt.Errorf("failed to create branch %q: %w: %s", opts.Branch, err, output)
+	}
+	return nil
+}
+
+// commitTransplant commits the files the transplant wrote or removed within
+// the destination: the managed files, go.mod and go.sum, the manifest, and
+// the tracked files the run removed. Other changes, such as those allowed by
+// -commit-allow-dirty, are left uncommitted.
+func commitTransplant(work *Work, opts *Options) error {
+	written := []string{work.DstGoMod, filepath.Join(work.DstDir, "go.sum")}
+	for _, dst := range work.GoFiles {
+		written = append(written, dst)
+	}
+	for _, dst := range work.OtherFiles {
+		written = append(written, dst)
+	}
+	for dst := range work.GeneratedFiles {
+		written = append(written, dst)
+	}
+	if path := manifestPath(work, opts); path != "" {
+		written = append(written, path)
+	}
+
+	var paths []string
+	for _, path := range written {
+		if !fileExists(path) {
+			continue
+		}
+		rel, err := filepath.Rel(work.DstDir, path)
+		if err != nil {
+			return fmt.Errorf("failed to make %q relative to the destination: %w", path, err)
+		}
+		paths = append(paths, rel)
+	}
+	// Only the deletions of tracked files the run itself removed are staged,
+	// leaving any others (allowed by -commit-allow-dirty) uncommitted.
+	deleted, err := gitPaths(work.DstDir, "ls-files", "--deleted", "--", ".")
+	if err != nil {
+		return fmt.Errorf("failed to list removed files: %w", err)
+	}
+	for _, path := range work.removed {
+		rel, err := filepath.Rel(work.DstDir, path)
+		if err != nil {
+			return fmt.Errorf("failed to make %q relative to the destination: %w", path, err)
+		}
+		if deleted[filepath.ToSlash(rel)] {
+			paths = append(paths, rel)
+			delete(deleted, filepath.ToSlash(rel))
+		}
+	}
+	sort.Strings(paths)
+	if len(paths) == 0 {
+		logger.Info("Nothing to commit")
+		return nil
+	}
+	if output, err := execInDirCombinedOutput(work.DstDir, "git", append([]string{"add", "--all", "--"}, paths...)...); err != nil {
+		return fmt.Errorf("failed to stage transplanted files: %w: %s", err, output)
+	}
+
+	changed, err := gitPaths(work.DstDir, append([]string{"diff", "--cached", "--name-only", "--relative", "--"}, paths...)...)
+	if err != nil {
+		return fmt.Errorf("failed to diff transplanted files: %w", err)
+	}
+	if len(changed) == 0 {
+		logger.Info("Nothing to commit")
+		return nil
+	}
+
+	message := opts.CommitMessage
+	if message == "" {
+		message = commitMessage(work)
+	}
+	logger.Info("Committing...", "files", len(changed))
+	args := append([]string{"commit", "--quiet", "--message", message, "--only", "--"}, paths...)
+	if output, err := execInDirCombinedOutput(work.DstDir, "git", args...); err != nil {
+		return fmt.Errorf("failed to commit transplant: %w: %s", err, output)
+	}
+	return nil
+}
+
+// commitMessage returns the default -commit message, naming the source
+// package and, if known, its commit.
+func commitMessage(work *Work) string {
+	message := fmt.Sprintf("Transplant %s into %s", work.SrcImportPath, work.DstModule)
+	if commit := sourceCommit(work.SrcModuleDir); commit != "" {
+		message += "\n\nSource commit: " + commit
+	}
+	return message
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCommitLeavesUnrelatedDeletionsUncommitted(t *testing.T) {
+	t.Setenv("GIT_CONFIG_GLOBAL", os.DevNull)
+	t.Setenv("GIT_AUTHOR_NAME", "test")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "test")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+
+	srcDir := newModule(t, "example.com/old", map[string]string{
+		"foo.go": "package foo\n\nfunc Foo() int { return 1 }\n",
+	})
+	dstDir := newModule(t, "example.com/new", map[string]string{
+		"old.go":        "package new\n",
+		"unrelated.txt": "keep me\n",
+	})
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"add", "--all"},
+		{"commit", "--quiet", "--message", "initial"},
+	} {
+		if output, err := execInDirCombinedOutput(dstDir, "git", args...); err != nil {
+			t.Fatalf("git %s failed: %v\n%s", args[0], err, output)
+		}
+	}
+	if err := os.Remove(filepath.Join(dstDir, "unrelated.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := testOptions()
+	opts.Commit = true
+	opts.CommitAllowDirty = true
+	if err := run(dstDir, srcDir, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := execInDirOutput(dstDir, "git", "status", "--porcelain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(status) != "D unrelated.txt" {
+		t.Errorf("expected only the unrelated deletion to be left uncommitted, got:\n%s", status)
+	}
+	committed, err := execInDirOutput(dstDir, "git", "show", "--name-status", "--format=", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"D\told.go", "A\tfoo.go"} {
+		if !strings.Contains(committed, want) {
+			t.Errorf("expected the commit to contain %q:\n%s", want, committed)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/zeebo/errs"
+)
+
+// configName is the name of the config file read from the current directory,
+// if present.
+const configName = ".mirage.json"
+
+// PackageOverride places an in-module dependency at an explicit destination,
+// in place of its automatic location beneath internal/. Dir is relative to
+// DSTDIR and ImportPath is the import path the package is given there. If
+// only Dir is given, the import path is Dir within the destination module; if
+// only ImportPath is given, it must be within the destination module and the
+// directory follows from it, as with -map.
+type PackageOverride struct {
+	Dir        string `json:"dir,omitempty"`
+	ImportPath string `json:"importPath,omitempty"`
+}
+
+// loadConfig decodes the config file at path, if it exists, into opts. The
+// config holds options in the format described by -print-schema=config, so it
+// must be loaded after the flag defaults are set and before the flags are
+// parsed, which then take precedence over it. Like the environment, the
+// config cannot set the options of envExemptFlags.
+func loadConfig(path string, opts *Options) error {
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return nil
+	case err != nil:
+		return errs.Wrap(err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return fmt.Errorf("failed to unmarshal config %q: %w", path, err)
+	}
+	for _, field := range sortedKeys(fields) {
+		for name := range envExemptFlags {
+			// encoding/json matches field names case-insensitively.
+			if strings.EqualFold(field, strings.ReplaceAll(name, "-", "")) {
+				return fmt.Errorf("config %q cannot set %q; -%s can only be given on the command line", path, field, name)
+			}
+		}
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(opts); err != nil {
+		return fmt.Errorf("failed to unmarshal config %q: %w", path, err)
+	}
+	return nil
+}
+
+// setAsideConfigValues empties the repeatable flags loaded from the config,
+// so that values given on the command line or in the environment replace the
+// config's values instead of adding to them. The returned function restores
+// the config's values of the flags that were not given either way; it must be
+// called after the flags are parsed and the environment defaults applied.
+func setAsideConfigValues(fs *flag.FlagSet) func() {
+	saved := make(map[string]stringsFlag)
+	fs.VisitAll(func(f *flag.Flag) {
+		if values, ok := f.Value.(*stringsFlag); ok && len(*values) > 0 {
+			saved[f.Name] = *values
+			*values = nil
+		}
+	})
+	return func() {
+		fs.Visit(func(f *flag.Flag) {
+			delete(saved, f.Name)
+		})
+		for name, values := range saved {
+			*fs.Lookup(name).Value.(*stringsFlag) = values
+		}
+	}
+}
+
+// addPackageOverrides adds the package overrides to the custom mappings,
+// recording the explicit destination directories. A -map for the same
+// package takes precedence over an override.
+func (w *Work) addPackageOverrides(overrides map[string]PackageOverride) error {
+	for _, src := range sortedKeys(overrides) {
+		override := overrides[src]
+		if _, ok := w.Mappings[src]; ok {
+			logger.Debug("Ignoring package override in favor of -map", "pkg", src)
+			continue
+		}
+		switch {
+		case override.Dir == "" && override.ImportPath == "":
+			return fmt.Errorf("invalid package override for %q: dir or importPath is required", src)
+		case override.Dir != "" && !filepath.IsLocal(filepath.FromSlash(override.Dir)):
+			return fmt.Errorf("invalid package override for %q: dir %q must be relative and within DSTDIR", src, override.Dir)
+		}
+
+		dstPkg := override.ImportPath
+		if dstPkg == "" {
+			dstPkg = path.Join(w.DstModule, filepath.ToSlash(override.Dir))
+		}
+		w.Mappings[src] = dstPkg
+		if override.Dir != "" {
+			w.PackageDirs[src] = filepath.Join(w.DstDir, filepath.FromSlash(override.Dir))
+		}
+	}
+	return nil
+}
+
+// checkPackageDirs ensures no package placed by an override shares its
+// destination directory with another package.
+func (w *Work) checkPackageDirs() error {
+	for _, src := range sortedKeys(w.PackageDirs) {
+		dir := w.PackageDirs[src]
+		for _, pkg := range w.Packages {
+			if pkg.SrcImportPath != src && filepath.Clean(pkg.DstDir) == filepath.Clean(dir) {
+				return fmt.Errorf("package override for %q collides with %q at %s", src, pkg.SrcImportPath, dir)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigRejectsExemptOptions(t *testing.T) {
+	dir := t.TempDir()
+	for field, flag := range map[string]string{
+		"undo":             "-undo",
+		"Force":            "-force",
+		"replay":           "-replay",
+		"emitPlan":         "-emit-plan",
+		"commitAllowDirty": "-commit-allow-dirty",
+	} {
+		t.Run(field, func(t *testing.T) {
+			path := filepath.Join(dir, field+".json")
+			writeFiles(t, dir, map[string]string{field + ".json": `{"dstModule": "example.com/new", "` + field + `": true}`})
+			err := loadConfig(path, new(Options))
+			if err == nil || !strings.Contains(err.Error(), flag+" can only be given on the command line") {
+				t.Fatalf("expected %s to be rejected, got %v", field, err)
+			}
+		})
+	}
+
+	writeFiles(t, dir, map[string]string{configName: `{"dstModule": "example.com/new", "goVersion": "1.22", "tests": true}`})
+	opts := new(Options)
+	if err := loadConfig(filepath.Join(dir, configName), opts); err != nil {
+		t.Fatal(err)
+	}
+	if opts.DstModule != "example.com/new" || opts.GoVersion != "1.22" || !opts.Tests {
+		t.Errorf("expected the config to be loaded, got %+v", opts)
+	}
+}
+
+func TestRepeatableFlagsReplaceConfigValues(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{configName: `{"mappings": ["example.com/a=example.com/new/a"], "extraFiles": ["LICENSE"]}`})
+	opts := new(Options)
+	if err := loadConfig(filepath.Join(dir, configName), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	flags := flag.NewFlagSet("mirage", flag.ContinueOnError)
+	flags.Var((*stringsFlag)(&opts.Mappings), "map", "")
+	flags.Var((*stringsFlag)(&opts.ExtraFiles), "extra-file", "")
+	flags.Var((*stringsFlag)(&opts.PackageRenames), "rename-pkg", "")
+	t.Setenv("MIRAGE_RENAME_PKG", "example.com/b=bee")
+	restoreConfig := setAsideConfigValues(flags)
+	if err := flags.Parse([]string{"-map=example.com/b=example.com/new/b", "-map=example.com/c=example.com/new/c"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyEnvDefaults(flags); err != nil {
+		t.Fatal(err)
+	}
+	restoreConfig()
+
+	if want := []string{"example.com/b=example.com/new/b", "example.com/c=example.com/new/c"}; !reflect.DeepEqual(opts.Mappings, want) {
+		t.Errorf("expected -map on the command line to replace the config's mappings, got %q", opts.Mappings)
+	}
+	if want := []string{"LICENSE"}; !reflect.DeepEqual(opts.ExtraFiles, want) {
+		t.Errorf("expected the config's extra files to be kept, got %q", opts.ExtraFiles)
+	}
+	if want := []string{"example.com/b=bee"}; !reflect.DeepEqual(opts.PackageRenames, want) {
+		t.Errorf("expected -rename-pkg from the environment, got %q", opts.PackageRenames)
+	}
+}
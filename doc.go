@@ -0,0 +1,236 @@
+// Mirage transplants a Go package, along with the packages it depends on
+// from within its own module, into another module.
+//
+// Usage:
+//
+//	mirage [flags] SRCDIR DSTDIR
+//
+// The package in SRCDIR is copied into DSTDIR and each in-module dependency
+// is copied beneath DSTDIR/internal. Imports are rewritten to the new paths,
+// the source go.mod is copied and renamed to the destination module, and
+// go mod tidy is run. SRCDIR may be the root of its module, in which case
+// the subpackages it imports are dependencies like any other: they are copied
+// beneath DSTDIR/internal by their path relative to the module root, and the
+// package copied into DSTDIR imports them from there.
+//
+// In a repository holding several modules, -in-repo-prefix treats the
+// packages beneath another import path prefix (e.g. a sibling module) as
+// in-module dependencies too: they are resolved with go list from the source
+// module, so it must require them (typically through a replace directive or
+// a go.work), and copied beneath DSTDIR/internal by their path relative to
+// the prefix.
+//
+// With -mirror-src-path the package is instead copied to its path relative
+// to the source module root within DSTDIR (e.g. the package at pkg/foo in the
+// source module is copied to DSTDIR/pkg/foo), keeping the destination layout
+// aligned with the source. Dependencies are still copied beneath
+// DSTDIR/internal, and paths given to -extra-file remain relative to DSTDIR.
+//
+// With -all-packages every package in the module containing SRCDIR is copied
+// instead, each to its path relative to the module root within DSTDIR, which
+// forks the whole module under the destination module path.
+//
+// A -src-pkg pattern of the form IMPORTPATH/... similarly copies every
+// package beneath IMPORTPATH, each to its path relative to IMPORTPATH within
+// DSTDIR. Dependencies that are not themselves matched are copied beneath
+// DSTDIR/internal once, however many of the matched packages import them.
+//
+// With -fan-out the same source is also transplanted into each additional
+// destination, in order, after DSTDIR. Each destination is planned for its
+// own module, but the source is only listed once. With -summary-json, the
+// summary file holds a list with the summary of each destination.
+//
+// With -vendor-mode, DSTDIR is a directory within an existing module (e.g.
+// third_party/foo) rather than a module root. The transplanted packages are
+// imported by their paths within the enclosing module (or beneath
+// -dst-module, if given), and neither the source go.mod nor any destination
+// go.mod is copied or edited, and go mod tidy is not run. Any requirements
+// the transplanted code needs must be added to the enclosing module by hand.
+//
+// # Plans
+//
+// With -emit-plan, mirage resolves the transplant (listing the source
+// packages, computing every copy and rewrite) and writes the plan as JSON
+// instead of executing it. -replay executes such a plan later without
+// listing the source again, which decouples planning from execution. The
+// source files named by the plan must still exist, and relative paths in it
+// are resolved against the current directory, as they were when planning.
+// Flags that affect planning are baked into the plan and ignored by -replay;
+// flags that affect execution (e.g. -mirror or -tidy-errors) still apply.
+// -emit-plan cannot be combined with -src-rev, since the plan would name
+// files in the temporary checkout of the revision.
+//
+// # Batches
+//
+// With -stdin, mirage reads transplants from stdin, one per line, each
+// either a source import path and destination directory separated by
+// whitespace, or a JSON object such as:
+//
+//	{"src": "../old/pkg/foo", "dst": "../new", "dstModule": "example.com/new"}
+//
+// where srcPkg may be given in place of src. Each is run in turn as an
+// independent transplant with the other flags. A failure does not stop the
+// rest of the batch; the status of every transplant is logged at the end, and
+// mirage exits non-zero if any failed.
+//
+// # Committing
+//
+// With -commit, mirage commits the transplant in the git repository holding
+// DSTDIR after a successful run: the managed files, go.mod, go.sum, and the
+// manifest, along with the tracked files the run removed. The message names
+// the source package and its commit, unless one is given as -commit=MESSAGE.
+// DSTDIR must have no uncommitted changes beforehand unless
+// -commit-allow-dirty is given, in which case those changes are left out of
+// the commit (except for removed tracked files, which cannot be told apart).
+// -branch=NAME switches to the branch, creating it from HEAD if needed,
+// before anything is written.
+//
+// # Verification
+//
+// With -verify, every package in the destination is built after the
+// transplant. By default go mod tidy runs first, so the build sees the
+// requirements the transplanted code needs. With -tidy-order=after the build
+// runs before tidy instead, which surfaces missing imports and other build
+// errors before tidy adds or prunes anything, but also reports errors for
+// requirements tidy would have added.
+//
+// # Offline use
+//
+// With -no-tidy-download, go mod tidy runs with GOPROXY=off and only uses
+// modules already in the module cache. This suits offline CI where the
+// dependencies of the source module are fetched ahead of time, but the run
+// fails if the transplant needs a module that is not in the cache (e.g. one
+// introduced by -add-replace or a new external import).
+//
+// # go list flags
+//
+// -golist-flags passes additional flags (e.g. -tags, -compiler, or -mod) to
+// each go list of the source, for setups where the default resolution does
+// not find the intended dependency set. The flags are split on spaces, and
+// flags that change the output go list produces (such as -json, -f, or -deps)
+// are rejected. Flags that change which files or dependencies are listed do
+// so for the whole transplant: files excluded by them are not copied, and
+// the destination go.mod is still tidied without them, so a transplant that
+// only builds with the flags may not tidy or build cleanly by default.
+//
+// # Environment
+//
+// Each flag not given on the command line defaults to the value of the
+// environment variable named by upper casing the flag, replacing dashes with
+// underscores, and prefixing MIRAGE_ (e.g. MIRAGE_DST_MODULE for -dst-module
+// and MIRAGE_LOCAL_IMPORTS for -local-imports). Repeatable flags (-map,
+// -extra-file, -rename-pkg, -add-replace, -fan-out, -shared-manifest, and
+// -in-repo-prefix) take a comma-separated list. The flags given on the
+// command line always take precedence over the environment, which takes
+// precedence over the built-in defaults. -go, -undo, -print-schema, -force,
+// -emit-plan, -replay, -stdin, and -commit-allow-dirty cannot be set from the
+// environment.
+//
+// # Config file
+//
+// Options may also be given in a .mirage.json file in the current directory,
+// in the format printed by -print-schema=config (e.g. {"dstModule":
+// "example.com/new", "tests": true}). Flags and the environment take
+// precedence over the config file; repeatable flags such as -map add to the
+// values it lists. Like the environment, the config file cannot set -undo,
+// -force, -emit-plan, -replay, or -commit-allow-dirty.
+//
+// The config file alone may place in-module dependencies explicitly, in
+// place of their automatic location beneath DSTDIR/internal, with a packages
+// section keyed by source import path:
+//
+//	"packages": {
+//		"example.com/old/util": {"dir": "pkg/util"},
+//		"example.com/old/log": {"dir": "third_party/log", "importPath": "example.com/new/third_party/log"}
+//	}
+//
+// dir is relative to DSTDIR, and importPath defaults to dir within the
+// destination module; with only importPath, the directory follows from it as
+// with -map. A -map (or -map-file) entry for the same package takes
+// precedence over its packages entry. A package placed by its packages entry
+// may not share a destination directory or import path with any other.
+//
+// # Toolchain directives
+//
+// godebug, toolchain, and other directives in the source go.mod are carried
+// over to the destination go.mod, which is a renamed copy of it. Only import
+// paths are rewritten in Go files, so file-level directives such as
+// //go:debug and //go:build are copied intact.
+//
+// # Generated code
+//
+// Only files present in the source are copied, so code produced by a
+// //go:generate directive is only transplanted if its output has been
+// generated (and typically committed) in the source. mirage warns about
+// directives whose output file, as named by a -o, -output, or -destination
+// flag, is missing from the source; run go generate there first.
+//
+// Arguments of //go:generate directives that name a transplanted package by
+// its source import path, on their own, as a flag value (e.g.
+// -self_package=IMPORTPATH), or qualifying a symbol, are rewritten to its
+// destination import path, so the directives keep working once transplanted.
+//
+// Generator programs are often kept in the package directory as main
+// packages excluded by //go:build ignore. They are copied like any other
+// file, but since they are not part of the package their imports are not
+// followed, so an in-module package that only a generator imports keeps its
+// source import path. -ignore-tagged=deps also transplants the in-module
+// dependencies of such files, and -ignore-tagged=drop leaves them out.
+//
+// # Managed files
+//
+// With -manifest=PATH (conventionally mirage-manifest.json, relative to
+// DSTDIR), mirage writes a manifest after each run listing every file it
+// wrote: copied Go files, copied non-Go files, and files it generated itself
+// (such as provenance files). These are the managed files. -mirror, -since,
+// and -prune-other rely on the manifest of the prior run, and with a manifest
+// a run refuses to overwrite destination packages holding Go files it does
+// not manage unless -force is given. The destination go.mod and go.sum are
+// never managed; they are rewritten by each run and left in place by -undo.
+// The source go.sum is never copied: the destination go.sum is removed
+// whenever go.mod is replaced by the source's and regenerated by go mod tidy
+// (with -no-tidy-download, which keeps tidy from fetching sums, it starts
+// from the source go.sum instead).
+//
+// The manifest also records the versions of go and goimports used. With
+// -require-go, a go version other than the one given is warned about, or is
+// an error with -strict, before anything is written. With -count-loc, the
+// manifest and the -summary-json summary also record the lines of Go code
+// copied (not counting blank or comment-only lines), in total and per
+// destination package.
+//
+// # Mirror mode
+//
+// By default each run removes every Go file beneath DSTDIR before copying,
+// managed or not, and then prunes the directories that removal left empty.
+// With -keep-empty-dirs those directories are kept instead, as are the
+// directories that held files listed in the prior manifest (with -manifest):
+// each one left without entries after copying gets a managed .gitkeep.
+// Directories mirage never wrote to are left alone. The .gitkeep files are
+// ordinary non-Go files to later runs, so they are only removed by -undo or by
+// -mirror once no longer produced. A plan that copies no Go files is refused
+// unless -allow-empty is given, since it would only wipe the destination.
+//
+// With -mirror, the destination is instead reconciled against the manifest of
+// the prior run:
+//
+//   - Managed files that the current plan no longer produces are removed,
+//     along with any directories left empty by their removal.
+//   - Managed files whose source is unchanged, whose destination content still
+//     matches the manifest, and whose rewriting inputs (import path
+//     replacements and formatting options) are unchanged are skipped.
+//   - Everything else in the plan is written, overwriting any file already at
+//     its destination path.
+//
+// Files that were never listed in a manifest are unmanaged and are never
+// removed by -mirror, so hand-written files alongside a mirrored package are
+// preserved. Re-running with the same source and options makes no changes.
+//
+// -since=REV is a lighter-weight alternative for keeping a fork up to date:
+// only the planned files whose source changed since the git revision REV
+// (including untracked files) are copied, and the destinations of source
+// files deleted since then are removed, as found in the manifest of the prior
+// run. Every other file is left as it is, and go mod tidy still runs over the
+// whole result. If the rewriting inputs changed since the prior run, every
+// file is copied.
+package main
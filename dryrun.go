@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/zeebo/errs"
+)
+
+// dryRun performs the transplant in a sandbox copy of the destination and
+// reports what it would do, leaving the destination untouched. Since go mod
+// tidy runs in the sandbox, the reported requirement changes are a
+// prediction: tidy may resolve differently when actually run later (e.g. if
+// new module versions are published in the meantime).
+func dryRun(dstDir, srcDir string, opts *Options) error {
+	tmpDir, err := os.MkdirTemp("", "mirage-dry-run-")
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	sandboxDir := filepath.Join(tmpDir, "dst")
+	work, err := sandboxTransplant(dstDir, srcDir, sandboxDir, opts)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Dry run: planned files", "go", len(work.GoFiles), "other", len(work.OtherFiles), "generated", len(work.GeneratedFiles), "packages", len(work.Packages))
+
+	before, err := getRequires(dstDir)
+	if err != nil {
+		return fmt.Errorf("failed to read destination requirements: %w", err)
+	}
+	after, err := getRequires(sandboxDir)
+	if err != nil {
+		return fmt.Errorf("failed to read predicted requirements: %w", err)
+	}
+
+	all := make(map[string]bool)
+	for path := range before {
+		all[path] = true
+	}
+	for path := range after {
+		all[path] = true
+	}
+	changes := 0
+	for _, path := range sortedKeys(all) {
+		from, to := before[path], after[path]
+		if from == to {
+			continue
+		}
+		changes++
+		switch {
+		case from == "":
+			logger.Info("Dry run: predicted requirement added", "module", path, "version", to)
+		case to == "":
+			logger.Info("Dry run: predicted requirement removed", "module", path, "version", from)
+		default:
+			logger.Info("Dry run: predicted requirement changed", "module", path, "from", from, "to", to)
+		}
+	}
+	if changes == 0 {
+		logger.Info("Dry run: predicted no requirement changes")
+	}
+	logger.Info("Dry run: requirement changes are a prediction from running go mod tidy in a temporary copy of the destination")
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+)
+
+// textEdit replaces the bytes in [Start, End) with Text.
+type textEdit struct {
+	Start int
+	End   int
+	Text  string
+}
+
+// applyEdits applies non-overlapping edits to data.
+func applyEdits(data []byte, edits []textEdit) []byte {
+	sort.Slice(edits, func(i, j int) bool {
+		return edits[i].Start < edits[j].Start
+	})
+
+	out := new(bytes.Buffer)
+	last := 0
+	for _, edit := range edits {
+		out.Write(data[last:edit.Start])
+		out.WriteString(edit.Text)
+		last = edit.End
+	}
+	out.Write(data[last:])
+	return out.Bytes()
+}
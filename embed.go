@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/zeebo/errs"
+)
+
+const embedDirective = "//go:embed "
+
+// checkEmbeds ensures the //go:embed patterns of each copied Go file match a
+// file that will be copied alongside it. Literal patterns naming a file that
+// has been relocated relative to the Go file are rewritten to its new
+// location; the rewrites are recorded in EmbedRewrites. go list does not
+// resolve the embeds of files excluded by build constraints (e.g. for other
+// platforms), so patterns in those that match nothing are only warned about.
+func (w *Work) checkEmbeds(strict bool) error {
+	var planned []string
+	for _, dst := range w.GoFiles {
+		planned = append(planned, dst)
+	}
+	for _, dst := range w.OtherFiles {
+		planned = append(planned, dst)
+	}
+
+	var problems []string
+	for _, src := range sortedKeys(w.GoFiles) {
+		dst := w.GoFiles[src]
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return errs.Wrap(err)
+		}
+		directives, err := parseEmbedDirectives(data)
+		if err != nil {
+			return fmt.Errorf("failed to parse embed directives in %q: %w", src, err)
+		}
+		if len(directives) == 0 {
+			continue
+		}
+
+		absSrc, err := filepath.Abs(src)
+		if err != nil {
+			return errs.Wrap(err)
+		}
+		excluded := w.excludedGoFiles[absSrc]
+
+		var rels []string
+		for _, other := range planned {
+			if rel, err := filepath.Rel(filepath.Dir(dst), other); err == nil && filepath.IsLocal(rel) {
+				rels = append(rels, filepath.ToSlash(rel))
+			}
+		}
+
+		for _, directive := range directives {
+			for _, pattern := range directive.Patterns {
+				if newPattern, ok := w.relocatedEmbed(src, dst, pattern); ok {
+					if w.EmbedRewrites[src] == nil {
+						w.EmbedRewrites[src] = make(map[string]string)
+					}
+					w.EmbedRewrites[src][pattern] = newPattern
+					logger.Debug("Rewriting relocated embed pattern", "src", src, "from", pattern, "to", newPattern)
+					pattern = newPattern
+				}
+				switch {
+				case embedMatches(pattern, rels):
+				case excluded:
+					if err := warn(strict, "Embed pattern in a file excluded from the build matches no copied files", "file", src, "line", directive.Line, "pattern", pattern); err != nil {
+						return err
+					}
+				default:
+					problems = append(problems, fmt.Sprintf("%s:%d: pattern %q", src, directive.Line, pattern))
+				}
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("embed patterns match no copied files (were the files excluded or relocated?):\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// relocatedEmbed returns the rewritten form of a literal embed pattern in the
+// Go file src (copied to dst) if the file it names is copied to a different
+// location relative to dst.
+func (w *Work) relocatedEmbed(src, dst, pattern string) (string, bool) {
+	literal := strings.TrimPrefix(pattern, "all:")
+	if strings.ContainsAny(literal, `*?[\`) {
+		return "", false
+	}
+	target, ok := w.OtherFiles[filepath.Join(filepath.Dir(src), filepath.FromSlash(literal))]
+	if !ok {
+		return "", false
+	}
+	rel, err := filepath.Rel(filepath.Dir(dst), target)
+	if err != nil || !filepath.IsLocal(rel) || filepath.ToSlash(rel) == literal {
+		return "", false
+	}
+	return strings.TrimSuffix(pattern, literal) + filepath.ToSlash(rel), true
+}
+
+// embedMatches returns true if the embed pattern matches any of the relative
+// paths, either directly or via one of its parent directories.
+func embedMatches(pattern string, rels []string) bool {
+	pattern = strings.TrimPrefix(pattern, "all:")
+	for _, rel := range rels {
+		for candidate := rel; candidate != "."; candidate = path.Dir(candidate) {
+			if ok, _ := path.Match(pattern, candidate); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type embedDirectiveInfo struct {
+	Line     int
+	Patterns []string
+}
+
+// parseEmbedDirectives returns the //go:embed directives in the Go source.
+func parseEmbedDirectives(data []byte) ([]embedDirectiveInfo, error) {
+	var directives []embedDirectiveInfo
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for line := 1; scanner.Scan(); line++ {
+		text, ok := strings.CutPrefix(scanner.Text(), embedDirective)
+		if !ok {
+			continue
+		}
+		patterns, err := splitEmbedPatterns(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		directives = append(directives, embedDirectiveInfo{Line: line, Patterns: patterns})
+	}
+	return directives, scanner.Err()
+}
+
+// splitEmbedPatterns splits the arguments of an embed directive, which are
+// separated by spaces and may be Go string literals.
+func splitEmbedPatterns(args string) ([]string, error) {
+	var patterns []string
+	for args = strings.TrimSpace(args); args != ""; args = strings.TrimSpace(args) {
+		if args[0] != '"' && args[0] != '`' {
+			end := strings.IndexAny(args, " \t")
+			if end < 0 {
+				end = len(args)
+			}
+			patterns = append(patterns, args[:end])
+			args = args[end:]
+			continue
+		}
+		quoted, err := strconv.QuotedPrefix(args)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quoted pattern in %q", args)
+		}
+		pattern, _ := strconv.Unquote(quoted)
+		patterns = append(patterns, pattern)
+		args = args[len(quoted):]
+	}
+	return patterns, nil
+}
+
+// rewriteEmbedDirectives applies the pattern rewrites to each //go:embed
+// directive in code.
+func rewriteEmbedDirectives(code string, rewrites map[string]string) string {
+	if len(rewrites) == 0 {
+		return code
+	}
+
+	lines := strings.SplitAfter(code, "\n")
+	for i, line := range lines {
+		text, ok := strings.CutPrefix(strings.TrimRight(line, "\r\n"), embedDirective)
+		if !ok {
+			continue
+		}
+		patterns, err := splitEmbedPatterns(text)
+		if err != nil {
+			continue
+		}
+		for j, pattern := range patterns {
+			if newPattern, ok := rewrites[pattern]; ok {
+				pattern = newPattern
+			}
+			if strings.ContainsAny(pattern, " \t\"`") {
+				pattern = strconv.Quote(pattern)
+			}
+			patterns[j] = pattern
+		}
+		lines[i] = embedDirective + strings.Join(patterns, " ") + line[len(strings.TrimRight(line, "\r\n")):]
+	}
+	return strings.Join(lines, "")
+}
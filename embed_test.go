@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckEmbedsWarnsForExcludedFiles(t *testing.T) {
+	srcDir := newModule(t, "example.com/old", map[string]string{
+		"foo.go":       "package foo\n\nfunc Foo() {}\n",
+		"foo_plan9.go": "package foo\n\nimport _ \"embed\"\n\n//go:embed plan9.txt\nvar plan9 string\n",
+		"plan9.txt":    "plan9\n",
+	})
+
+	dstDir := newModule(t, "example.com/new", nil)
+	if _, err := transplantForTest(t, dstDir, srcDir, testOptions()); err != nil {
+		t.Fatalf("expected the unresolved embed in an excluded file not to fail the run: %v", err)
+	}
+	buildModule(t, dstDir)
+
+	opts := testOptions()
+	opts.Strict = true
+	_, err := transplantForTest(t, newModule(t, "example.com/new", nil), srcDir, opts)
+	if err == nil || !strings.Contains(err.Error(), "plan9.txt") {
+		t.Fatalf("expected -strict to fail on the unresolved embed, got %v", err)
+	}
+}
+
+func TestCheckEmbedsFailsForBuiltFiles(t *testing.T) {
+	srcDir := newModule(t, "example.com/old", map[string]string{
+		"foo.go":   "package foo\n\nimport _ \"embed\"\n\n//go:embed data.txt\nvar data string\n",
+		"data.txt": "data\n",
+	})
+	opts := testOptions()
+	opts.OtherExtDeny = ".txt"
+	_, err := transplantForTest(t, newModule(t, "example.com/new", nil), srcDir, opts)
+	if err == nil || !strings.Contains(err.Error(), "embed patterns match no copied files") {
+		t.Fatalf("expected the embed of a file left out of the copy to fail the run, got %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/zeebo/errs"
+)
+
+// gitkeepName is the name of the placeholder written by -keep-empty-dirs.
+const gitkeepName = ".gitkeep"
+
+// keepEmptyDirs adds a .gitkeep to the generated files for each managed
+// destination directory left without any entries after copying: those
+// emptied by cleaning the destination, and those that held files listed in
+// the prior manifest, if any. Directories the transplant never wrote to are
+// left alone. The placeholder makes the directory part of the managed files,
+// so it is neither pruned nor lost on commit.
+func (w *Work) keepEmptyDirs(emptied []string, prior *Manifest) error {
+	dirs := make(map[string]bool)
+	for _, dir := range emptied {
+		dirs[dir] = true
+	}
+	if prior != nil {
+		for _, file := range prior.Files {
+			if dir := path.Dir(file.Dst); dir != "." {
+				dirs[filepath.Join(w.DstDir, filepath.FromSlash(dir))] = true
+			}
+		}
+	}
+
+	// Deeper directories come first, since a directory holding one that is
+	// kept is not empty.
+	sorted := sortedKeys(dirs)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i]) > len(sorted[j])
+	})
+	held := make(map[string]bool)
+	for _, dir := range sorted {
+		if held[dir] {
+			continue
+		}
+		entries, err := os.ReadDir(dir)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+		case err != nil:
+			return errs.Wrap(err)
+		case len(entries) == 1 && entries[0].Name() == gitkeepName:
+			// Kept by a prior run; it stays managed.
+		case len(entries) > 0:
+			continue
+		}
+		logger.Debug("Keeping empty directory", "dir", dir)
+		if w.GeneratedFiles == nil {
+			w.GeneratedFiles = make(map[string][]byte)
+		}
+		w.GeneratedFiles[filepath.Join(dir, gitkeepName)] = []byte{}
+		for parent := filepath.Dir(dir); parent != filepath.Dir(parent); parent = filepath.Dir(parent) {
+			held[parent] = true
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeepEmptyDirsOnlyKeepsManagedDirectories(t *testing.T) {
+	srcDir := newModule(t, "example.com/old", map[string]string{
+		"foo.go":            "package foo\n\nimport \"example.com/old/sub\"\n\nvar Foo = sub.Sub\n",
+		"sub/sub.go":        "package sub\n\nvar Sub = 1\n",
+		"testdata/data.txt": "fixture\n",
+	})
+	dstDir := newModule(t, "example.com/new", nil)
+	if err := os.Mkdir(filepath.Join(dstDir, "placeholder"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := testOptions()
+	opts.Manifest = defaultManifestName
+	opts.Mirror = true
+	opts.KeepEmptyDirs = true
+	if _, err := transplantForTest(t, dstDir, srcDir, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// The source no longer imports sub, so its directory is only kept
+	// because the prior manifest lists files in it.
+	writeFiles(t, srcDir, map[string]string{
+		"foo.go": "package foo\n\nvar Foo = 1\n",
+	})
+	if _, err := transplantForTest(t, dstDir, srcDir, opts); err != nil {
+		t.Fatal(err)
+	}
+	if !fileExists(filepath.Join(dstDir, "internal", "sub", gitkeepName)) {
+		t.Errorf("expected the directory of the dropped package to be kept")
+	}
+	for _, rel := range []string{"testdata", "placeholder/" + gitkeepName} {
+		if _, err := os.Stat(filepath.Join(dstDir, filepath.FromSlash(rel))); !os.IsNotExist(err) {
+			t.Errorf("expected %s not to be written (err=%v)", rel, err)
+		}
+	}
+
+	// The placeholder stays managed on later runs.
+	if _, err := transplantForTest(t, dstDir, srcDir, opts); err != nil {
+		t.Fatal(err)
+	}
+	if !fileExists(filepath.Join(dstDir, "internal", "sub", gitkeepName)) {
+		t.Errorf("expected the kept directory to survive another run")
+	}
+}
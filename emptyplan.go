@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// emptyPlanReason explains why the work copies no Go files, which is almost
+// always a misconfiguration (e.g. the wrong SRCDIR).
+func emptyPlanReason(work *Work) string {
+	if len(work.Packages) == 0 {
+		return "no source packages were planned"
+	}
+	for _, pkg := range work.Packages {
+		matches, err := filepath.Glob(filepath.Join(pkg.SrcDir, "*.go"))
+		if err == nil && len(matches) > 0 {
+			return fmt.Sprintf("every Go file in %s was excluded (e.g. by -only-platform, build constraints, or being a test file without -tests)", pkg.SrcDir)
+		}
+	}
+	if _, err := os.Stat(work.Packages[0].SrcDir); err != nil {
+		return fmt.Sprintf("the source directory %s cannot be read: %v", work.Packages[0].SrcDir, err)
+	}
+	return fmt.Sprintf("the source directory %s holds no Go files", work.Packages[0].SrcDir)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/zeebo/errs"
+)
+
+const (
+	eolLF       = "lf"
+	eolCRLF     = "crlf"
+	eolPreserve = "preserve"
+)
+
+// normalizeEOL converts every line ending in data to the given style.
+func normalizeEOL(data []byte, eol string) []byte {
+	switch eol {
+	case eolLF:
+		return bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	case eolCRLF:
+		data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+		return bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+	default:
+		return data
+	}
+}
+
+// normalizeFileEOL converts the line endings of the file at path in place.
+// Files that look binary (i.e. contain a NUL byte near the start) are left
+// untouched.
+func normalizeFileEOL(path, eol string) error {
+	if eol == eolPreserve {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	if bytes.IndexByte(data[:min(len(data), 8000)], 0) >= 0 {
+		return nil
+	}
+
+	normalized := normalizeEOL(data, eol)
+	if bytes.Equal(normalized, data) {
+		return nil
+	}
+	if err := writeFile(path, normalized); err != nil {
+		return fmt.Errorf("failed to normalize line endings: %w", err)
+	}
+	return nil
+}
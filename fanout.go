@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// fanOut transplants the source into DSTDIR and then into each -fan-out
+// destination. The package info listed while planning the first destination
+// is reused for the rest, so the source is only listed once.
+func fanOut(dstDir, srcDir string, opts *Options) error {
+	if filepath.IsAbs(opts.Manifest) {
+		return errors.New("-fan-out cannot be combined with an absolute -manifest path, which every destination would share")
+	}
+
+	type destination struct{ dir, module string }
+	dsts := []destination{{dir: dstDir, module: opts.DstModule}}
+	for _, spec := range opts.FanOut {
+		dir, module, _ := strings.Cut(spec, "=")
+		if dir == "" {
+			return fmt.Errorf("invalid fan-out destination %q; expected DIR[=MODULE]", spec)
+		}
+		dsts = append(dsts, destination{dir: dir, module: module})
+	}
+
+	var prior *Work
+	var summaries []*Summary
+	for _, dst := range dsts {
+		dstOpts := *opts
+		dstOpts.DstModule = dst.module
+
+		if opts.Init {
+			if err := initDst(dst.dir, &dstOpts); err != nil {
+				return err
+			}
+		}
+		logger.Info("Building work...", "dst", dst.dir)
+		work, err := getWorkCached(dst.dir, srcDir, &dstOpts, prior)
+		if err != nil {
+			return fmt.Errorf("failed to plan destination %q: %w", dst.dir, err)
+		}
+
+		logger.Info("Checking destination is writable...", "dst", dst.dir)
+		if err := checkDstWritable(work.DstDir); err != nil {
+			return err
+		}
+		if err := doWork(work, &dstOpts); err != nil {
+			return fmt.Errorf("failed to transplant into destination %q: %w", dst.dir, err)
+		}
+
+		logger.Info("Transplanted destination",
+			"dst", work.DstDir,
+			"module", work.DstModule,
+			"goFiles", len(work.GoFiles),
+			"otherFiles", len(work.OtherFiles),
+			"generatedFiles", len(work.GeneratedFiles))
+		if work.summary != nil {
+			summaries = append(summaries, work.summary)
+		}
+		prior = work
+	}
+
+	// Each run wrote its own summary over the last; replace them with the
+	// summaries of every destination.
+	if opts.SummaryJSON != "" {
+		return writeSummary(opts.SummaryJSON, summaries)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// parseExtList parses a comma-separated list of file extensions such as
+// ".json,.proto" into a set.
+func parseExtList(list string) (map[string]bool, error) {
+	if list == "" {
+		return nil, nil
+	}
+	exts := make(map[string]bool)
+	for _, ext := range strings.Split(list, ",") {
+		ext = strings.TrimSpace(ext)
+		if len(ext) < 2 || !strings.HasPrefix(ext, ".") || strings.ContainsAny(ext[1:], `./\`) {
+			return nil, fmt.Errorf("invalid extension %q; expected a form like .json", ext)
+		}
+		exts[ext] = true
+	}
+	return exts, nil
+}
+
+// filterOtherFiles removes non-Go files from the work whose extension is not
+// in allow (when set) or is in deny. Files in exempt are always kept. Each
+// skipped file is reported along with the total number of bytes not copied.
+func (w *Work) filterOtherFiles(allow, deny map[string]bool, exempt map[string]bool) {
+	if allow == nil && deny == nil {
+		return
+	}
+
+	var skipped int
+	var saved int64
+	for _, src := range sortedKeys(w.OtherFiles) {
+		ext := filepath.Ext(src)
+		if exempt[src] || (allow == nil || allow[ext]) && !deny[ext] {
+			continue
+		}
+		var size int64
+		if info, err := os.Stat(src); err == nil {
+			size = info.Size()
+		}
+		logger.Info("Skipping non-Go file", "src", src, "bytes", size)
+		delete(w.OtherFiles, src)
+		skipped++
+		saved += size
+	}
+	if skipped > 0 {
+		logger.Info("Skipped non-Go files by extension", "files", skipped, "bytes", saved)
+	}
+}
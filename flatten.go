@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// flattenPackageName is the name of the single package that in-module
+// dependencies are flattened into with -flatten-deps. It is also the final
+// element of its directory beneath internal/.
+const flattenPackageName = "vendored"
+
+// addFlattenedCopies adds the files of the in-module dependency with the
+// given import path suffix to the flattened package directory. Go files are
+// prefixed with the suffix to avoid collisions between packages; other files
+// keep their names so embed patterns continue to match, as do testdata files,
+// which are copied verbatim.
+func (w *Work) addFlattenedCopies(srcDir, suffix string, files, testdata []string) error {
+	prefix := strings.ReplaceAll(suffix, "/", "_") + "_"
+	for _, file := range files {
+		dst := filepath.Join(w.FlattenDir, file)
+		if filepath.Ext(file) == ".go" {
+			dst = filepath.Join(w.FlattenDir, prefix+file)
+		}
+		if err := w.addCopy(filepath.Join(srcDir, file), dst); err != nil {
+			return fmt.Errorf("cannot flatten: %w", err)
+		}
+	}
+	for _, file := range testdata {
+		if err := w.addVerbatimCopy(filepath.Join(srcDir, file), filepath.Join(w.FlattenDir, file)); err != nil {
+			return fmt.Errorf("cannot flatten: %w", err)
+		}
+	}
+	return nil
+}
+
+// checkFlattenedDecls ensures that no two flattened packages declare the same
+// top-level identifier. Colliding identifiers of all but the first package to
+// declare them are renamed where possible (exported ones only if
+// allowExportRename is set).
+func (w *Work) checkFlattenedDecls(allowExportRename bool) error {
+	var srcs []string
+	for src, dst := range w.GoFiles {
+		if filepath.Dir(dst) == w.FlattenDir && !strings.HasSuffix(src, "_test.go") {
+			srcs = append(srcs, src)
+		}
+	}
+	sort.Strings(srcs)
+
+	allDecls := make(map[string][]string)
+	taken := make(map[string]bool)
+	for _, src := range srcs {
+		decls, err := readFileDecls(src)
+		if err != nil {
+			return fmt.Errorf("failed to inspect source file %q: %w", src, err)
+		}
+		allDecls[src] = decls.Idents
+		for _, ident := range decls.Idents {
+			taken[ident] = true
+		}
+	}
+
+	declaredBy := make(map[string]string)
+	var duplicates []string
+	for _, src := range srcs {
+		for _, ident := range allDecls[src] {
+			other, ok := declaredBy[ident]
+			switch {
+			case !ok:
+				declaredBy[ident] = src
+			case filepath.Dir(other) != filepath.Dir(src):
+				pkg := w.packageForFile(src)
+				if pkg == nil {
+					duplicates = append(duplicates, fmt.Sprintf("%s (declared in %s and %s)", ident, other, src))
+					continue
+				}
+				if _, err := w.renameIdent(pkg, ident, taken, allowExportRename); err != nil {
+					duplicates = append(duplicates, fmt.Sprintf("%s (declared in %s and %s; %v)", ident, other, src, err))
+				}
+			}
+		}
+	}
+	if len(duplicates) > 0 {
+		return fmt.Errorf("cannot flatten dependencies; duplicate top-level identifiers:\n  %s", strings.Join(duplicates, "\n  "))
+	}
+	return nil
+}
+
+// flattenImports rewrites the source of a Go file so that references to the
+// flattened packages (keyed by source import path with their package names as
+// values) resolve against the single flattened package at flattenPath. Files
+// that are part of the flattened package drop those imports entirely and
+// reference the identifiers directly. Other files import the flattened
+// package once, by its package name.
+func flattenImports(filename string, data []byte, flattened map[string]string, flattenPath string, inFlattened bool) ([]byte, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, filename, data, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	offset := func(pos token.Pos) int {
+		return fset.Position(pos).Offset
+	}
+
+	var edits []textEdit
+	if inFlattened {
+		name := flattenPackageName
+		if strings.HasSuffix(file.Name.Name, "_test") {
+			name += "_test"
+		}
+		edits = append(edits, textEdit{Start: offset(file.Name.Pos()), End: offset(file.Name.End()), Text: name})
+	}
+
+	// Determine the local names the flattened packages are referenced by and
+	// drop or redirect their imports.
+	localNames := make(map[string]bool)
+	kept := false
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.IMPORT {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			spec := spec.(*ast.ImportSpec)
+			importPath, _ := strconv.Unquote(spec.Path.Value)
+			name, ok := flattened[importPath]
+			if !ok {
+				continue
+			}
+			if spec.Name != nil {
+				name = spec.Name.Name
+			}
+			localNames[name] = true
+
+			edit := textEdit{Start: offset(spec.Pos()), End: offset(spec.End())}
+			if !gen.Lparen.IsValid() {
+				// Edit the whole declaration for a single unparenthesized
+				// import rather than leaving a bare import keyword.
+				edit.Start, edit.End = offset(gen.Pos()), offset(gen.End())
+			}
+			if !inFlattened && !kept {
+				edit.Text = strconv.Quote(flattenPath)
+				if !gen.Lparen.IsValid() {
+					edit.Text = "import " + edit.Text
+				}
+				kept = true
+			}
+			edits = append(edits, edit)
+		}
+	}
+	if len(edits) == 0 {
+		return data, nil
+	}
+
+	ast.Inspect(file, func(n ast.Node) bool {
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		ident, ok := sel.X.(*ast.Ident)
+		if !ok || ident.Obj != nil || !localNames[ident.Name] {
+			return true
+		}
+		if inFlattened {
+			edits = append(edits, textEdit{Start: offset(ident.Pos()), End: offset(sel.Sel.Pos())})
+		} else {
+			edits = append(edits, textEdit{Start: offset(ident.Pos()), End: offset(ident.End()), Text: flattenPackageName})
+		}
+		return false
+	})
+
+	return applyEdits(data, edits), nil
+}
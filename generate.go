@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zeebo/errs"
+)
+
+const generateDirective = "//go:generate "
+
+// generateOutputFlags are the generator flags commonly used to name the file
+// a //go:generate command writes (e.g. stringer -output, mockgen
+// -destination).
+var generateOutputFlags = map[string]bool{
+	"-o":            true,
+	"-output":       true,
+	"--output":      true,
+	"-destination":  true,
+	"--destination": true,
+}
+
+// missingGenerateOutputs returns a description of each //go:generate
+// directive in the copied Go files whose output Go file, as named by one of
+// the generateOutputFlags, is not present in the source. Generated files are
+// only copied if they are committed, so the transplanted package would be
+// missing whatever the generator produces.
+func (w *Work) missingGenerateOutputs() ([]string, error) {
+	var missing []string
+	for _, src := range sortedKeys(w.GoFiles) {
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return nil, errs.Wrap(err)
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(nil, len(data)+1)
+		for line := 1; scanner.Scan(); line++ {
+			text, ok := strings.CutPrefix(scanner.Text(), generateDirective)
+			if !ok {
+				continue
+			}
+			for _, output := range generateOutputs(strings.Fields(text)) {
+				if !fileExists(filepath.Join(filepath.Dir(src), filepath.FromSlash(output))) {
+					missing = append(missing, fmt.Sprintf("%s:%d: output %q", src, line, output))
+				}
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, errs.Wrap(err)
+		}
+	}
+	return missing, nil
+}
+
+// generateOutputs returns the Go files named by output flags in the arguments
+// of a //go:generate directive.
+func generateOutputs(args []string) []string {
+	var outputs []string
+	for i, arg := range args {
+		flag, value, ok := strings.Cut(arg, "=")
+		if !generateOutputFlags[flag] {
+			continue
+		}
+		if !ok {
+			if i+1 >= len(args) {
+				continue
+			}
+			value = args[i+1]
+		}
+		value = strings.Trim(value, `"`)
+		if filepath.Ext(value) == ".go" {
+			outputs = append(outputs, value)
+		}
+	}
+	return outputs
+}
+
+// rewriteGenerateDirectives rewrites the arguments of each //go:generate
+// directive in code that name a source import path, whether on their own
+// (e.g. mockgen's package argument), as the value of a flag (e.g.
+// -self_package=IMPORTPATH), or qualifying a symbol. Other arguments are left
+// intact. Quoted import paths are rewritten along with the rest of the file.
+func rewriteGenerateDirectives(code string, paths map[string]string) string {
+	if !strings.Contains(code, generateDirective) {
+		return code
+	}
+
+	lines := strings.SplitAfter(code, "\n")
+	for i, line := range lines {
+		if !strings.HasPrefix(line, generateDirective) {
+			continue
+		}
+		var b strings.Builder
+		rest := line
+		for rest != "" {
+			end := strings.IndexAny(rest, " \t\r\n")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				b.WriteByte(rest[0])
+				rest = rest[1:]
+				continue
+			}
+			b.WriteString(rewriteGenerateArg(rest[:end], paths))
+			rest = rest[end:]
+		}
+		lines[i] = b.String()
+	}
+	return strings.Join(lines, "")
+}
+
+// rewriteGenerateArg rewrites a single //go:generate argument naming a source
+// import path.
+func rewriteGenerateArg(arg string, paths map[string]string) string {
+	prefix := ""
+	if flag, value, ok := strings.Cut(arg, "="); ok && strings.HasPrefix(flag, "-") {
+		prefix, arg = flag+"=", value
+	}
+	if dstPkg, ok := paths[arg]; ok {
+		return prefix + dstPkg
+	}
+	if symbol, ok := rewriteQualifiedSymbol(arg, paths); ok {
+		return prefix + symbol
+	}
+	return prefix + arg
+}
@@ -1,5 +1,5 @@
 module github.com/azdagron/mirror
 
-go 1.20
+go 1.21
 
 require github.com/zeebo/errs v1.3.0
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// renameIdent records that the top-level identifier old declared by the
+// package is renamed to avoid a collision. The new name is old suffixed with
+// the package name (and a number, if needed) such that taken reports it is
+// free. Exported identifiers are only renamed if allowExported is set, since
+// code outside of the transplant may refer to them.
+func (w *Work) renameIdent(pkg *WorkPackage, old string, taken map[string]bool, allowExported bool) (string, error) {
+	if token.IsExported(old) && !allowExported {
+		return "", fmt.Errorf("%s is exported; use -allow-export-rename to rename it", old)
+	}
+	if renamed, ok := w.IdentRenames[pkg.SrcImportPath][old]; ok {
+		return renamed, nil
+	}
+
+	base := old + "_" + pkg.Name
+	name := base
+	for i := 2; taken[name]; i++ {
+		name = base + strconv.Itoa(i)
+	}
+	taken[name] = true
+
+	if w.IdentRenames[pkg.SrcImportPath] == nil {
+		w.IdentRenames[pkg.SrcImportPath] = make(map[string]string)
+	}
+	w.IdentRenames[pkg.SrcImportPath][old] = name
+	logger.Debug("Renaming colliding identifier", "pkg", pkg.SrcImportPath, "from", old, "to", name)
+	return name, nil
+}
+
+// checkIdentRenames ensures the identifier renames can be applied to every
+// copied Go file.
+func (w *Work) checkIdentRenames() error {
+	if len(w.IdentRenames) == 0 {
+		return nil
+	}
+	own, qualified := w.identRenameSets()
+	for _, src := range sortedKeys(w.GoFiles) {
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return fmt.Errorf("failed to read source file %q: %w", src, err)
+		}
+		var ownRenames map[string]string
+		if pkg := w.packageForFile(src); pkg != nil {
+			ownRenames = own[pkg.SrcDir]
+		}
+		if _, err := renameIdents(src, data, ownRenames, qualified); err != nil {
+			return fmt.Errorf("cannot rename colliding identifiers: %w", err)
+		}
+	}
+	return nil
+}
+
+// identRenameSets returns the identifier renames keyed by the source
+// directory of the renamed package, for the files of the package itself, and
+// the exported identifier renames keyed by source import path along with the
+// package name, for the files that import it.
+func (w *Work) identRenameSets() (own map[string]map[string]string, qualified map[string]qualifiedRenames) {
+	own = make(map[string]map[string]string)
+	qualified = make(map[string]qualifiedRenames)
+	for importPath, renames := range w.IdentRenames {
+		pkg := w.findPackage(importPath)
+		if pkg == nil {
+			continue
+		}
+		own[pkg.SrcDir] = renames
+		for old, name := range renames {
+			if !token.IsExported(old) {
+				continue
+			}
+			if qualified[importPath].Idents == nil {
+				qualified[importPath] = qualifiedRenames{Name: pkg.Name, Idents: make(map[string]string)}
+			}
+			qualified[importPath].Idents[old] = name
+		}
+	}
+	return own, qualified
+}
+
+// qualifiedRenames holds the renamed exported identifiers of a package, which
+// other packages refer to qualified by the package name.
+type qualifiedRenames struct {
+	Name   string
+	Idents map[string]string
+}
+
+// renameIdents rewrites the source of a Go file for identifier renames. own
+// holds the renames of the package the file belongs to, if any, which apply
+// to the declarations of the identifiers and every unqualified reference to
+// them. qualified holds the renames of exported identifiers keyed by import
+// path, which apply to references qualified by the name of the import. It is
+// an error if a reference is ambiguous (e.g. a composite literal key that may
+// be a struct field) or a new name is already used by the file.
+func renameIdents(filename string, data []byte, own map[string]string, qualified map[string]qualifiedRenames) ([]byte, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, filename, data, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	offset := func(pos token.Pos) int {
+		return fset.Position(pos).Offset
+	}
+
+	importRenames := make(map[string]map[string]string)
+	for _, spec := range file.Imports {
+		importPath, _ := strconv.Unquote(spec.Path.Value)
+		renames, ok := qualified[importPath]
+		if !ok {
+			continue
+		}
+		name := renames.Name
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+		switch name {
+		case ".":
+			return nil, fmt.Errorf("%s: %q is dot-imported, so references to its renamed identifiers cannot be found", fset.Position(spec.Pos()), importPath)
+		case "_":
+			continue
+		}
+		importRenames[name] = renames.Idents
+	}
+	if len(own) == 0 && len(importRenames) == 0 {
+		return data, nil
+	}
+
+	topLevel := make(map[any]bool)
+	for _, decl := range file.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			topLevel[decl] = true
+		case *ast.GenDecl:
+			for _, spec := range decl.Specs {
+				topLevel[spec] = true
+			}
+		}
+	}
+	newNames := make(map[string]bool)
+	for _, name := range own {
+		newNames[name] = true
+	}
+	for _, renames := range importRenames {
+		for _, name := range renames {
+			newNames[name] = true
+		}
+	}
+
+	var edits []textEdit
+	var problems []string
+	skip := make(map[*ast.Ident]bool)
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.File:
+			skip[n.Name] = true
+		case *ast.FuncDecl:
+			if n.Recv != nil {
+				// Methods are not top-level identifiers.
+				skip[n.Name] = true
+			}
+		case *ast.SelectorExpr:
+			skip[n.Sel] = true
+			if x, ok := n.X.(*ast.Ident); ok && x.Obj == nil {
+				if newName, ok := importRenames[x.Name][n.Sel.Name]; ok {
+					edits = append(edits, textEdit{Start: offset(n.Sel.Pos()), End: offset(n.Sel.End()), Text: newName})
+				}
+			}
+		case *ast.CompositeLit:
+			for _, elt := range n.Elts {
+				kv, ok := elt.(*ast.KeyValueExpr)
+				if !ok {
+					continue
+				}
+				if key, ok := kv.Key.(*ast.Ident); ok && own[key.Name] != "" {
+					problems = append(problems, fmt.Sprintf("%s: %s may be a struct field or a reference", fset.Position(key.Pos()), key.Name))
+					skip[key] = true
+				}
+			}
+		case *ast.Ident:
+			if skip[n] {
+				return true
+			}
+			if newNames[n.Name] {
+				problems = append(problems, fmt.Sprintf("%s: %s is already used", fset.Position(n.Pos()), n.Name))
+				return true
+			}
+			newName, ok := own[n.Name]
+			if !ok {
+				return true
+			}
+			if n.Obj != nil && !topLevel[n.Obj.Decl] {
+				// A local declaration that shadows the identifier.
+				return true
+			}
+			edits = append(edits, textEdit{Start: offset(n.Pos()), End: offset(n.End()), Text: newName})
+		}
+		return true
+	})
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+
+	if len(edits) == 0 {
+		return data, nil
+	}
+	return applyEdits(data, edits), nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFlattenDepsRenamesUnexportedCollision(t *testing.T) {
+	srcDir := newModule(t, "example.com/old", map[string]string{
+		"b/b.go":          "package b\n\nimport (\n\t\"example.com/old/internal/a\"\n\t\"example.com/old/internal/c\"\n)\n\nvar B = a.A() + c.C()\n",
+		"internal/a/a.go": "package a\n\nfunc helper() int { return 1 }\n\nfunc A() int { return helper() }\n",
+		"internal/c/c.go": "package c\n\nfunc helper() int { return 2 }\n\nfunc C() int {\n\thelper := helper()\n\treturn helper\n}\n",
+	})
+	dstDir := newModule(t, "example.com/new", nil)
+
+	opts := testOptions()
+	opts.FlattenDeps = true
+	work, err := transplantForTest(t, dstDir, filepath.Join(srcDir, "b"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := work.IdentRenames["example.com/old/internal/c"]["helper"]; got != "helper_c" {
+		t.Errorf("expected helper of c to be renamed to helper_c, got %q", got)
+	}
+	c := readFile(t, filepath.Join(dstDir, "internal", flattenPackageName, "internal_c_c.go"))
+	// The local variable shadows the renamed function, so only the call
+	// within its initializer refers to the function.
+	for _, want := range []string{"func helper_c() int", "helper := helper_c()", "return helper\n"} {
+		if !strings.Contains(c, want) {
+			t.Errorf("expected the flattened c.go to contain %q:\n%s", want, c)
+		}
+	}
+	buildModule(t, dstDir)
+}
+
+func TestFlattenDepsRenamesExportedCollision(t *testing.T) {
+	srcDir := newModule(t, "example.com/old", map[string]string{
+		"b/b.go":          "package b\n\nimport (\n\t\"example.com/old/internal/a\"\n\t\"example.com/old/internal/c\"\n)\n\nvar B = a.Version + c.Version\n",
+		"internal/a/a.go": "package a\n\nconst Version = 1\n",
+		"internal/c/c.go": "package c\n\nconst Version = 2\n",
+	})
+
+	dstDir := newModule(t, "example.com/new", nil)
+	opts := testOptions()
+	opts.FlattenDeps = true
+	_, err := transplantForTest(t, dstDir, filepath.Join(srcDir, "b"), opts)
+	if err == nil || !strings.Contains(err.Error(), "Version is exported; use -allow-export-rename to rename it") {
+		t.Fatalf("expected the exported collision to be refused, got %v", err)
+	}
+
+	dstDir = newModule(t, "example.com/new", nil)
+	opts = testOptions()
+	opts.FlattenDeps = true
+	opts.AllowExportRename = true
+	if _, err := transplantForTest(t, dstDir, filepath.Join(srcDir, "b"), opts); err != nil {
+		t.Fatal(err)
+	}
+	c := readFile(t, filepath.Join(dstDir, "internal", flattenPackageName, "internal_c_c.go"))
+	if !strings.Contains(c, "const Version_c = 2") {
+		t.Errorf("expected Version of c to be renamed:\n%s", c)
+	}
+	b := readFile(t, filepath.Join(dstDir, "b.go"))
+	if !strings.Contains(b, flattenPackageName+".Version + "+flattenPackageName+".Version_c") {
+		t.Errorf("expected the qualified reference in b.go to be renamed:\n%s", b)
+	}
+	buildModule(t, dstDir)
+}
+
+func TestRenameIdentsRejectsCompositeLiteralKeys(t *testing.T) {
+	src := "package c\n\ntype T struct{ helper int }\n\nfunc helper() int { return 2 }\n\nvar _ = T{helper: 1}\n"
+	_, err := renameIdents("c.go", []byte(src), map[string]string{"helper": "helper_c"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "helper may be a struct field or a reference") {
+		t.Fatalf("expected the composite literal key to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"go/build/constraint"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ignoreTaggedCopy copies files excluded by the ignore build tag (e.g.
+	// generator programs kept alongside a package) like any other file.
+	ignoreTaggedCopy = "copy"
+
+	// ignoreTaggedDeps copies them and also follows their in-module
+	// imports, so the dependencies they need are transplanted too.
+	ignoreTaggedDeps = "deps"
+
+	// ignoreTaggedDrop leaves them out of the transplant.
+	ignoreTaggedDrop = "drop"
+)
+
+// ignoreTaggedFiles returns the Go files of the package excluded from the
+// build by a constraint on the ignore tag (conventionally //go:build ignore),
+// which are standalone programs such as generators rather than part of the
+// package.
+func (info *packageInfo) ignoreTaggedFiles() []string {
+	var files []string
+	for _, file := range info.IgnoredGoFiles {
+		data, err := os.ReadFile(filepath.Join(info.Dir, file))
+		if err != nil {
+			continue
+		}
+		if hasIgnoreTag(data) {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// hasIgnoreTag reports whether the build constraints of the Go source, which
+// must precede the package clause, refer to the ignore tag.
+func hasIgnoreTag(data []byte) bool {
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "package ") {
+			break
+		}
+		if !constraint.IsGoBuild(line) && !constraint.IsPlusBuild(line) {
+			continue
+		}
+		expr, err := constraint.Parse(line)
+		if err != nil {
+			continue
+		}
+		found := false
+		expr.Eval(func(tag string) bool {
+			found = found || tag == "ignore"
+			return false
+		})
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// ignoreTaggedImports returns the imports of the package's ignore-tagged
+// files. Files that do not parse are left for copying to report.
+func (info *packageInfo) ignoreTaggedImports() []string {
+	var imports []string
+	for _, file := range info.ignoreTaggedFiles() {
+		parsed, err := parser.ParseFile(token.NewFileSet(), filepath.Join(info.Dir, file), nil, parser.ImportsOnly)
+		if err != nil {
+			continue
+		}
+		for _, spec := range parsed.Imports {
+			if importPath, err := strconv.Unquote(spec.Path.Value); err == nil {
+				imports = append(imports, importPath)
+			}
+		}
+	}
+	return imports
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"go/parser"
+	"go/printer"
+	"go/token"
+)
+
+// formatKeepingImportOrder formats Go source like gofmt, except that the
+// imports are left in the order they are written rather than sorted within
+// each block, for -prefer-source-order.
+func formatKeepingImportOrder(src []byte) ([]byte, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", src, parser.ParseComments|parser.SkipObjectResolution)
+	if err != nil {
+		return nil, err
+	}
+	// These are the settings gofmt prints with, including go/format's
+	// unexported mode bit for normalizing number literals (e.g. 0X1 to
+	// 0x1); it is go/format.Source that sorts the imports beforehand.
+	const normalizeNumbers printer.Mode = 1 << 30
+	config := printer.Config{Mode: printer.UseSpaces | printer.TabIndent | normalizeNumbers, Tabwidth: 8}
+	formatted := new(bytes.Buffer)
+	if err := config.Fprint(formatted, fset, file); err != nil {
+		return nil, err
+	}
+	return formatted.Bytes(), nil
+}
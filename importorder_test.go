@@ -0,0 +1,29 @@
+package main
+
+import (
+	"go/format"
+	"strings"
+	"testing"
+)
+
+func TestFormatKeepingImportOrder(t *testing.T) {
+	src := "package foo\n\nimport (\n\t\"os\"\n\t\"fmt\"\n)\n\nvar (\n\tx  = 0X1F\n\ty = 1E5\n\tz = 0B101\n\t_, _ = fmt.Println, os.Exit\n)\n"
+
+	got, err := formatKeepingImportOrder([]byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(got), "\t\"os\"\n\t\"fmt\"\n") {
+		t.Errorf("expected the import order to be kept:\n%s", got)
+	}
+
+	// Apart from the import order, the output matches gofmt's.
+	sorted := strings.Replace(src, "\t\"os\"\n\t\"fmt\"\n", "\t\"fmt\"\n\t\"os\"\n", 1)
+	want, err := format.Source([]byte(sorted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Replace(string(got), "\t\"os\"\n\t\"fmt\"\n", "\t\"fmt\"\n\t\"os\"\n", 1); got != string(want) {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
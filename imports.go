@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strconv"
+)
+
+// mergeDuplicateImports removes repeated imports of the same path, which
+// rewriting produces when two source import paths map to the same
+// destination path. Repeats under the same name are dropped, and references
+// to a repeat under a different name are redirected to the name of the first
+// import. A repeat that cannot be reconciled (e.g. one named and one unnamed
+// import, whose package name is not known here) is an error.
+func mergeDuplicateImports(filename string, data []byte) ([]byte, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, filename, data, parser.ImportsOnly|parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	type kept struct {
+		name  string
+		named bool
+	}
+	first := make(map[string]kept)
+	renamed := make(map[string]string)
+	var edits []textEdit
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.IMPORT {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			spec := spec.(*ast.ImportSpec)
+			importPath, _ := strconv.Unquote(spec.Path.Value)
+			var name string
+			if spec.Name != nil {
+				name = spec.Name.Name
+			}
+
+			prior, ok := first[importPath]
+			if !ok && name != "_" {
+				first[importPath] = kept{name: name, named: spec.Name != nil}
+				continue
+			}
+			switch {
+			case !ok:
+				// A blank import ahead of any other import of its path
+				// is left alone.
+				continue
+			case name == prior.name || name == "_":
+			case name == "." || prior.name == "." || !prior.named || spec.Name == nil:
+				return nil, fmt.Errorf("%s: %q is imported as both %s and %s after rewriting", fset.Position(spec.Pos()), importPath, importName(prior.name), importName(name))
+			default:
+				renamed[name] = prior.name
+			}
+
+			edit := lineEdit(fset, data, spec.Pos(), spec.End())
+			if !gen.Lparen.IsValid() {
+				edit = lineEdit(fset, data, gen.Pos(), gen.End())
+			}
+			edits = append(edits, edit)
+		}
+	}
+	if len(edits) == 0 {
+		return data, nil
+	}
+
+	if len(renamed) > 0 {
+		// Only the imports were parsed so far; references need the whole
+		// file.
+		full, err := parser.ParseFile(fset, filename, data, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		ast.Inspect(full, func(n ast.Node) bool {
+			sel, ok := n.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			ident, ok := sel.X.(*ast.Ident)
+			if !ok || ident.Obj != nil {
+				return true
+			}
+			if name, ok := renamed[ident.Name]; ok {
+				edits = append(edits, textEdit{Start: fset.Position(ident.Pos()).Offset, End: fset.Position(ident.End()).Offset, Text: name})
+			}
+			return true
+		})
+	}
+
+	return applyEdits(data, edits), nil
+}
+
+// lineEdit returns an edit removing [pos, end), extended to the whole line if
+// nothing else is on it.
+func lineEdit(fset *token.FileSet, data []byte, pos, end token.Pos) textEdit {
+	edit := textEdit{Start: fset.Position(pos).Offset, End: fset.Position(end).Offset}
+	start := edit.Start
+	for start > 0 && (data[start-1] == ' ' || data[start-1] == '\t') {
+		start--
+	}
+	if (start == 0 || data[start-1] == '\n') && edit.End < len(data) && data[edit.End] == '\n' {
+		edit.Start, edit.End = start, edit.End+1
+	}
+	return edit
+}
+
+// importName describes the name of an import for error messages.
+func importName(name string) string {
+	if name == "" {
+		return "its package name"
+	}
+	return strconv.Quote(name)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMergeDuplicateImports(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		src  string
+		want string
+		err  string
+	}{
+		{
+			name: "same name",
+			src:  "package foo\n\nimport (\n\t\"example.com/new/x\"\n\t\"example.com/new/x\"\n)\n\nvar _ = x.X\n",
+			want: "package foo\n\nimport (\n\t\"example.com/new/x\"\n)\n\nvar _ = x.X\n",
+		},
+		{
+			name: "different aliases",
+			src:  "package foo\n\nimport (\n\ta \"example.com/new/x\"\n\tb \"example.com/new/x\"\n)\n\nvar _ = a.A + b.B\n",
+			want: "package foo\n\nimport (\n\ta \"example.com/new/x\"\n)\n\nvar _ = a.A + a.B\n",
+		},
+		{
+			name: "blank repeat",
+			src:  "package foo\n\nimport \"example.com/new/x\"\nimport _ \"example.com/new/x\"\n\nvar _ = x.X\n",
+			want: "package foo\n\nimport \"example.com/new/x\"\n\nvar _ = x.X\n",
+		},
+		{
+			name: "named and unnamed",
+			src:  "package foo\n\nimport (\n\t\"example.com/new/x\"\n\ty \"example.com/new/x\"\n)\n\nvar _ = x.X + y.Y\n",
+			err:  `"example.com/new/x" is imported as both its package name and "y" after rewriting`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mergeDuplicateImports("foo.go", []byte(tt.src))
+			switch {
+			case tt.err != "":
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error containing %q, got %v", tt.err, err)
+				}
+			case err != nil:
+				t.Fatal(err)
+			case string(got) != tt.want:
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransplantMergesImportsOfFlattenedDependencies(t *testing.T) {
+	srcDir := newModule(t, "example.com/old", map[string]string{
+		"b/b.go":          "package b\n\nimport (\n\t\"example.com/old/internal/a\"\n\t\"example.com/old/internal/c\"\n)\n\nvar B = a.A + c.C\n",
+		"internal/a/a.go": "package a\n\nvar A = 1\n",
+		"internal/c/c.go": "package c\n\nvar C = 1\n",
+	})
+	dstDir := newModule(t, "example.com/new", nil)
+
+	opts := testOptions()
+	opts.FlattenDeps = true
+	if _, err := transplantForTest(t, dstDir, filepath.Join(srcDir, "b"), opts); err != nil {
+		t.Fatal(err)
+	}
+	got := readFile(t, filepath.Join(dstDir, "b.go"))
+	if n := strings.Count(got, `"example.com/new/internal/`); n != 1 {
+		t.Errorf("expected a single import of the flattened package, got %d:\n%s", n, got)
+	}
+	buildModule(t, dstDir)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// initDst creates the destination directory with a go.mod for -dst-module
+// (and -go, if given) when it does not exist or is empty, for -init.
+// Destinations with anything in them are left as they are.
+func initDst(dstDir string, opts *Options) error {
+	entries, err := os.ReadDir(dstDir)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return fmt.Errorf("failed to read destination: %w", err)
+	case len(entries) > 0:
+		return nil
+	}
+	if opts.DstModule == "" {
+		return errors.New("-init requires -dst-module to name the new destination module")
+	}
+
+	logger.Info("Initializing destination module...", "dst", dstDir, "module", opts.DstModule)
+	if err := ensureDir(dstDir); err != nil {
+		return fmt.Errorf("failed to create destination: %w", err)
+	}
+	if output, err := execInDirCombinedOutput(dstDir, goBin, "mod", "init", opts.DstModule); err != nil {
+		return fmt.Errorf("failed to initialize destination module: %w: %s", err, output)
+	}
+	if opts.GoVersion != "" {
+		if err := execInDir(dstDir, goBin, "mod", "edit", "-go", opts.GoVersion); err != nil {
+			return fmt.Errorf("failed to set destination go version: %w", err)
+		}
+	}
+	return nil
+}
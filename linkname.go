@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zeebo/errs"
+)
+
+// rewriteLinknames rewrites the import path qualifying the target symbol of
+// each //go:linkname directive in code according to paths.
+func rewriteLinknames(code string, paths map[string]string) string {
+	if !strings.Contains(code, "//go:linkname ") {
+		return code
+	}
+
+	lines := strings.SplitAfter(code, "\n")
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "//go:linkname ") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		if target, ok := rewriteQualifiedSymbol(fields[2], paths); ok {
+			lines[i] = strings.Replace(line, fields[2], target, 1)
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// rewriteQualifiedSymbol rewrites a symbol of the form importpath.name. The
+// package name is the portion up to the first dot after the last slash.
+func rewriteQualifiedSymbol(symbol string, paths map[string]string) (string, bool) {
+	slash := strings.LastIndex(symbol, "/")
+	dot := strings.Index(symbol[slash+1:], ".")
+	if dot < 0 {
+		return "", false
+	}
+	dot += slash + 1
+
+	dstPkg, ok := paths[symbol[:dot]]
+	if !ok {
+		return "", false
+	}
+	return dstPkg + symbol[dot:], true
+}
+
+// copyAsmFile copies an assembly file, rewriting package-qualified symbols.
+// Assembly spells import paths with a division slash (U+2215) in place of
+// each slash and separates the symbol name with a middle dot (U+00B7).
+func copyAsmFile(srcPath, dstPath string, paths map[string]string) error {
+	data, err := os.ReadFile(srcPath)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+
+	var oldnew []string
+	for srcPkg, dstPkg := range paths {
+		oldnew = append(oldnew, asmSymbolPrefix(srcPkg), asmSymbolPrefix(dstPkg))
+	}
+	code := strings.NewReplacer(oldnew...).Replace(string(data))
+
+	if err := ensureDir(filepath.Dir(dstPath)); err != nil {
+		return fmt.Errorf("failed to ensure destination directory exists: %w", err)
+	}
+	if err := writeFile(dstPath, []byte(code)); err != nil {
+		return fmt.Errorf("failed to write destination file: %w", err)
+	}
+	return nil
+}
+
+func asmSymbolPrefix(importPath string) string {
+	return strings.ReplaceAll(importPath, "/", "∕") + "·"
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"go/scanner"
+	"go/token"
+	"os"
+)
+
+// LOC counts the lines of Go code written by a transplant, with -count-loc.
+// Lines holding only comments or whitespace are not counted. Packages maps
+// the destination import path of each package to its count.
+type LOC struct {
+	Total    int            `json:"total"`
+	Packages map[string]int `json:"packages"`
+}
+
+// countLOC counts the lines of code in the destination Go files of the work.
+func countLOC(work *Work) (*LOC, error) {
+	loc := &LOC{Packages: make(map[string]int)}
+	for _, src := range sortedKeys(work.GoFiles) {
+		dst := work.GoFiles[src]
+		lines, err := countCodeLines(dst)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count lines of %q: %w", dst, err)
+		}
+		pkgPath := work.DstModule
+		if pkg := work.packageForFile(src); pkg != nil {
+			pkgPath = pkg.DstImportPath
+		}
+		loc.Total += lines
+		loc.Packages[pkgPath] += lines
+	}
+	return loc, nil
+}
+
+// countCodeLines returns the number of lines of the Go file holding at least
+// one token other than a comment.
+func countCodeLines(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	fset := token.NewFileSet()
+	file := fset.AddFile(path, -1, len(data))
+	var s scanner.Scanner
+	s.Init(file, data, nil, 0)
+
+	lines := make(map[int]bool)
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		// Automatically inserted semicolons are not code.
+		if tok == token.SEMICOLON && lit == "\n" {
+			continue
+		}
+		lines[file.Line(pos)] = true
+	}
+	return len(lines), nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// newLogger returns the logger for the given -log-format writing to w,
+// without timestamps if noTimestamps is set. Text output goes through the
+// standard log package, as it always has.
+func newLogger(format string, w io.Writer, noTimestamps bool) (*slog.Logger, error) {
+	switch format {
+	case "text":
+		flags := log.LstdFlags
+		if noTimestamps {
+			flags = 0
+		}
+		log.SetOutput(w)
+		log.SetFlags(flags)
+		return slog.New(new(textHandler)), nil
+	case "json":
+		handlerOpts := &slog.HandlerOptions{Level: slog.LevelDebug}
+		if noTimestamps {
+			handlerOpts.ReplaceAttr = func(groups []string, attr slog.Attr) slog.Attr {
+				if len(groups) == 0 && attr.Key == slog.TimeKey {
+					return slog.Attr{}
+				}
+				return attr
+			}
+		}
+		return slog.New(slog.NewJSONHandler(w, handlerOpts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+}
+
+// textHandler writes info and higher records through the standard log
+// package as the message followed by its attributes as key=value pairs.
+// Unlike slog's default handler, it does not prefix messages with their
+// level, except to mark warnings.
+type textHandler struct {
+	attrs  []slog.Attr
+	prefix string
+}
+
+func (h *textHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= slog.LevelInfo
+}
+
+func (h *textHandler) Handle(_ context.Context, record slog.Record) error {
+	line := new(strings.Builder)
+	if record.Level == slog.LevelWarn {
+		line.WriteString("WARN ")
+	}
+	line.WriteString(record.Message)
+	for _, attr := range h.attrs {
+		writeTextAttr(line, "", attr)
+	}
+	record.Attrs(func(attr slog.Attr) bool {
+		writeTextAttr(line, h.prefix, attr)
+		return true
+	})
+	return log.Output(0, line.String())
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handler := &textHandler{prefix: h.prefix}
+	handler.attrs = append(handler.attrs, h.attrs...)
+	for _, attr := range attrs {
+		attr.Key = h.prefix + attr.Key
+		handler.attrs = append(handler.attrs, attr)
+	}
+	return handler
+}
+
+func (h *textHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &textHandler{attrs: h.attrs, prefix: h.prefix + name + "."}
+}
+
+// writeTextAttr writes the attribute as " key=value", quoting values that are
+// empty or would otherwise be ambiguous.
+func writeTextAttr(line *strings.Builder, prefix string, attr slog.Attr) {
+	attr.Value = attr.Value.Resolve()
+	if attr.Equal(slog.Attr{}) {
+		return
+	}
+	if attr.Value.Kind() == slog.KindGroup {
+		for _, member := range attr.Value.Group() {
+			writeTextAttr(line, prefix+attr.Key+".", member)
+		}
+		return
+	}
+	value := attr.Value.String()
+	if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+		value = strconv.Quote(value)
+	}
+	fmt.Fprintf(line, " %s%s=%s", prefix, attr.Key, value)
+}
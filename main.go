@@ -6,104 +6,787 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
 	"io"
 	"io/fs"
-	"log"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/zeebo/errs"
 )
 
+// logger receives progress events. Phases are logged at info level and
+// per-file events at debug level.
+var logger = slog.Default()
+
+// goBin is the go command used for all go list and go mod invocations.
+var goBin = "go"
+
+// execObserver is called after each external command is run. It is set from
+// Options.ExecObserver.
+var execObserver func(cmd []string, dir string, dur time.Duration, err error)
+
 func main() {
 	opts := new(Options)
+	var logFormat, logFile string
+	var noTimestamps, stdin bool
+	var schema string
 
 	fs := flag.NewFlagSet("mirage", flag.ExitOnError)
 	fs.StringVar(&opts.DstModule, "dst-module", "", "The destination module name (autodetected via destination go.mod if unset)")
-	fs.BoolVar(&opts.LocalImports, "local-imports", true, "Fix up imports to treat the destination module as local imports")
+	opts.LocalImports = true
+	fs.Var((*localImportsFlag)(opts), "local-imports", "Fix up imports to treat the destination module as local imports; a prefix (e.g. a vanity import path) may be given instead of true, as with -local-prefix")
+	fs.StringVar(&opts.SrcPkg, "src-pkg", "", "The import path of the source package, resolved with go list from the current directory, in place of SRCDIR; IMPORTPATH/... copies every package beneath IMPORTPATH, keeping their layout, along with their dependencies")
+	fs.Var((*stringsFlag)(&opts.InRepoPrefixes), "in-repo-prefix", "An import path prefix, such as another module in the same repository, whose packages are copied beneath internal/ like in-module dependencies (repeatable)")
+	fs.StringVar(&opts.SrcModule, "src-module", "", "The source module path used to detect in-module dependencies (taken from go list if unset; must be a prefix of the source import path)")
+	fs.StringVar(&opts.LocalPrefix, "local-prefix", "", "The comma-separated import path prefixes passed to goimports -local (defaults to the destination module when -local-imports is set)")
+	fs.Var((*stringsFlag)(&opts.AddReplaces), "add-replace", "A replace directive to add to the destination go.mod before tidying, as OLD[@VERSION]=NEW[@VERSION] (repeatable)")
+	fs.BoolVar(&opts.Init, "init", false, "Create DSTDIR with a go.mod for -dst-module (and -go) if it does not exist or is empty")
+	fs.StringVar(&opts.GoVersion, "go", "", "The go directive to set in the destination go.mod (the source go.mod's directive is kept if unset)")
+	fs.BoolVar(&opts.CheckProto, "check-proto", false, "Warn about generated protobuf (.pb.go) files whose embedded descriptors reference source import paths")
+	fs.BoolVar(&opts.WarnTextual, "warn-textual", false, "Warn about source import paths in string literals or comments that will be rewritten along with the imports")
+	fs.Var((*stringsFlag)(&opts.FanOut), "fan-out", "An additional destination to transplant into after DSTDIR, as DIR[=MODULE]; MODULE defaults to the module of the go.mod in DIR (repeatable)")
+	fs.Var((*stringsFlag)(&opts.ExtraFiles), "extra-file", "An additional file to copy verbatim, as SRCREL[:DSTREL] relative to the source module and destination directories (repeatable)")
+	fs.StringVar(&opts.Manifest, "manifest", "", "Write a manifest of managed files to the given path, relative to DSTDIR, after each run (e.g. "+defaultManifestName+"); required by -mirror, -since, and -prune-other")
+	fs.BoolVar(&opts.CountLOC, "count-loc", false, "Count the lines of Go code copied, in total and per package, and record them in the manifest and summary")
+	fs.StringVar(&opts.SummaryJSON, "summary-json", "", "Write a compact JSON summary of the run (counts, source commit, added and updated requirements, timing) to the given path")
+	fs.BoolVar(&opts.PruneOther, "prune-other", false, "Remove non-Go files recorded in the prior manifest that are no longer produced")
+	fs.BoolVar(&opts.RewriteAsm, "rewrite-asm", false, "Rewrite package-qualified symbols in assembly (.s) files")
+	fs.BoolVar(&opts.FlattenDeps, "flatten-deps", false, "Flatten all in-module dependencies into the single package internal/"+flattenPackageName)
+	fs.BoolVar(&opts.NoImportPrune, "no-import-prune", false, "Format copied Go files with gofmt instead of goimports so that no imports are removed")
+	fs.BoolVar(&opts.PreferSourceOrder, "prefer-source-order", false, "Keep the imports of copied Go files in their source order, formatting them with gofmt's spacing but without goimports or gofmt sorting (implies -no-import-prune, so -local-imports and -local-prefix have no effect)")
+	fs.BoolVar(&opts.CheckFmt, "check-fmt", false, "Fail if any destination Go file is not gofmt-clean after copying")
+	fs.BoolVar(&opts.FormatGenerated, "format-generated", false, "Run goimports over generated files (those marked \"Code generated ... DO NOT EDIT.\") too")
+	fs.Var((*stringsFlag)(&opts.Mappings), "map", "A custom import path mapping as SRC=DST; in-module dependencies are relocated to DST (repeatable)")
+	fs.Var((*stringsFlag)(&opts.PackageRenames), "rename-pkg", "Rename the package clause of a transplanted package, and references to it, as IMPORTPATH=NEWNAME (repeatable)")
+	fs.StringVar(&opts.MapFile, "map-file", "", "A file of custom import path mappings, one SRC=DST per line")
+	fs.BoolVar(&opts.ReportUnusedMappings, "report-unused-mappings", false, "Warn about custom mappings that never matched an import")
+	fs.StringVar(&opts.APIDump, "api-dump", "", "Write the exported API of the source package to the given path and warn about any of it the transplanted package does not declare identically")
+	fs.BoolVar(&opts.FmtGoMod, "fmt-gomod", false, "Canonically format the destination go.mod with go mod edit -fmt after tidying")
+	fs.BoolVar(&opts.Verify, "verify", false, "Build every package in the destination after transplanting")
+	fs.StringVar(&opts.IgnoreTagged, "ignore-tagged", ignoreTaggedCopy, "How to handle Go files excluded by the ignore build tag, such as inline generator programs: copy them, copy them and transplant their in-module dependencies (deps), or drop them")
+	fs.StringVar(&opts.TidyOrder, "tidy-order", tidyOrderBefore, "Whether go mod tidy runs before or after the -verify build (before or after)")
+	fs.BoolVar(&opts.NoTidyDownload, "no-tidy-download", false, "Run go mod tidy with GOPROXY=off so it only uses modules already in the module cache")
+	fs.StringVar(&opts.TidyErrors, "tidy-errors", tidyErrorsFail, "How to handle go mod tidy errors: fail, or continue (run go mod tidy -e and report the errors as warnings)")
+	fs.BoolVar(&opts.Strict, "strict", false, "Treat warnings (e.g. unused mappings, textual rewrites, missing go:generate outputs) as errors")
+	fs.IntVar(&opts.MaxDepPackages, "max-dep-packages", 0, "Fail once more than N in-module dependency packages have been queued (0 for no limit)")
+	fs.IntVar(&opts.DstInternalDepth, "dst-internal-depth", 0, "Collapse dependency paths beneath internal/ to their last N elements (0 keeps the full path)")
+	fs.BoolVar(&opts.Provenance, "provenance", false, "Write a build-ignored "+provenanceFileName+" into each destination package recording its source import path and commit")
+	fs.StringVar(&opts.OtherExtAllow, "other-ext-allow", "", "Comma-separated extensions (e.g. .json,.proto) of the only non-Go files to copy; extra files are always copied")
+	fs.StringVar(&opts.OtherExtDeny, "other-ext-deny", "", "Comma-separated extensions of non-Go files not to copy; extra files are always copied")
+	fs.BoolVar(&opts.Watch, "watch", false, "Keep running, transplanting again whenever the source changes (combine with -mirror to skip unchanged files); stop with Ctrl-C")
+	fs.StringVar(&opts.Since, "since", "", "Only copy the source files changed since the given git revision, removing those deleted since then, and leave the rest of the destination as the prior run left it")
+	fs.Var((*stringsFlag)(&opts.SharedManifests), "shared-manifest", "The manifest of another transplant into DSTDIR, relative to DSTDIR; files it manages are kept, and reused if this transplant would write the same content (repeatable)")
+	fs.BoolVar(&opts.Mirror, "mirror", false, "Keep the destination an exact mirror of the plan using the manifest: stale managed files are removed, unchanged ones skipped, and unmanaged files left alone")
+	fs.BoolVar(&opts.AllowEmpty, "allow-empty", false, "Proceed even if the plan copies no Go files, which cleans the destination of Go files and copies none")
+	fs.BoolVar(&opts.KeepEmptyDirs, "keep-empty-dirs", false, "Write a .gitkeep into destination directories left without files (those emptied by cleaning, or that held files of the prior manifest) instead of pruning them")
+	fs.StringVar(&opts.RequireGo, "require-go", "", "The go version (e.g. go1.22.4) the go command must report; a different version is warned about, or fails with -strict")
+	fs.StringVar(&opts.GoListFlags, "golist-flags", "", "Additional space-separated flags passed to each go list of the source (e.g. -tags=foo or -compiler=gccgo); see the package documentation for the risks")
+	fs.BoolVar(&opts.AnalyzeTags, "analyze-tags", false, "Warn about copied Go files that do not build for the platform of -only-platform (or the current one) with the -tags given in -golist-flags")
+	fs.StringVar(&opts.OnlyPlatform, "only-platform", "", "Only copy the files (and dependencies) buildable for the given GOOS/GOARCH, dropping those for other platforms")
+	fs.BoolVar(&opts.Tests, "tests", false, "Copy test files too, following the imports of the tests (including test-only packages)")
+	fs.Var((*modeFlag)(&opts.FileMode), "file-mode", "The permissions, in octal, of files written to the destination (defaults to 0644)")
+	fs.Var((*modeFlag)(&opts.DirMode), "dir-mode", "The permissions, in octal, of directories created in the destination (defaults to 0755)")
+	fs.BoolVar(&opts.PreserveSymlinks, "preserve-symlinks", false, "Recreate symlinked non-Go files as symlinks (which must stay within DSTDIR) instead of copying their contents; symlinks in testdata are otherwise skipped")
+	fs.StringVar(&opts.EOL, "eol", "", "The line endings for copied files: lf, crlf, or preserve (defaults to lf for Go files and preserve for other files)")
+	fs.StringVar(&opts.SrcRev, "src-rev", "", "A git revision of the source to transplant, checked out into a temporary worktree")
+	fs.StringVar(&opts.DiffRev, "diff-rev", "", "With -src-rev, transplant both revisions into temporary directories and print a diff between them instead of writing DSTDIR")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "Transplant into a temporary copy of DSTDIR and report the planned files and predicted go.mod requirement changes instead of writing DSTDIR")
+	fs.StringVar(&opts.Patch, "patch", "", "Write a unified diff of the changes the run would make to DSTDIR to the given file (- for stdout) instead of making them")
+	fs.BoolVar(&opts.AllPackages, "all-packages", false, "Copy every package in the source module, keeping the module's layout, instead of a single package and its dependencies")
+	fs.BoolVar(&opts.MirrorSrcPath, "mirror-src-path", false, "Place the source package at its path relative to the source module root within DSTDIR instead of at DSTDIR itself")
+	fs.BoolVar(&opts.VendorMode, "vendor-mode", false, "Copy into DSTDIR within an enclosing module, importing it by its path in that module, without editing any go.mod or running go mod tidy")
+	fs.BoolVar(&opts.AllowExportRename, "allow-export-rename", false, "Allow exported identifiers that collide with -merge or -flatten-deps to be renamed (unexported ones always are)")
+	fs.BoolVar(&opts.Merge, "merge", false, "Merge into existing destination packages instead of cleaning the destination (colliding file names are prefixed, and colliding identifiers are renamed; exported ones only with -allow-export-rename)")
+	fs.StringVar(&goBin, "go-bin", envOr("MIRAGE_GO", "go"), "The go command to use (defaults to $MIRAGE_GO, then go)")
+	fs.StringVar(&schema, "print-schema", "", "Print the JSON Schema for the manifest or config (options) format and exit")
+	fs.StringVar(&logFormat, "log-format", "text", "The log output format (text or json); json emits every phase and per-file event as a JSON object")
+	fs.StringVar(&logFile, "log-file", "", "Append log output to the given path instead of writing it to stderr")
+	fs.BoolVar(&noTimestamps, "no-timestamps", false, "Omit timestamps from log output")
+	fs.StringVar(&opts.Undo, "undo", "", "Undo the transplant recorded in the given manifest instead of transplanting (DSTDIR defaults to the manifest's directory)")
+	fs.StringVar(&opts.EmitPlan, "emit-plan", "", "Write the resolved plan as JSON to the given path instead of transplanting")
+	fs.StringVar(&opts.Replay, "replay", "", "Execute the plan written by -emit-plan at the given path instead of planning (SRCDIR and DSTDIR come from the plan)")
+	fs.BoolVar(&stdin, "stdin", false, "Read transplants from stdin, one per line as IMPORTPATH DSTDIR or a JSON object with src or srcPkg, dst, and dstModule, and run each in turn with the other flags")
+	fs.Var((*commitFlag)(opts), "commit", "Commit the transplanted files in the destination git repository after a successful run; a commit message may be given instead of true")
+	fs.StringVar(&opts.Branch, "branch", "", "With -commit, the branch to commit to, switched to (and created from HEAD if needed) before anything is written")
+	fs.BoolVar(&opts.CommitAllowDirty, "commit-allow-dirty", false, "With -commit, proceed even if the destination has uncommitted changes, which are left out of the commit")
+	fs.BoolVar(&opts.Force, "force", false, "Proceed despite safety checks (e.g. overwrite unmanaged destination packages, or remove modified files with -undo)")
+	if err := loadConfig(configName, opts); err != nil {
+		badUsage(err.Error())
+	}
+	restoreConfig := setAsideConfigValues(fs)
 	fs.Parse(os.Args[1:])
 	args := fs.Args()
+	if err := applyEnvDefaults(fs); err != nil {
+		badUsage(err.Error())
+	}
+	restoreConfig()
+
+	logOutput := io.Writer(os.Stderr)
+	if logFile != "" {
+		f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			badUsage(fmt.Sprintf("failed to open log file: %v", err))
+		}
+		defer f.Close()
+		logOutput = f
+	}
+	var err error
+	logger, err = newLogger(logFormat, logOutput, noTimestamps)
+	if err != nil {
+		badUsage(err.Error())
+	}
 
+	if schema != "" {
+		data, err := printSchema(schema)
+		if err != nil {
+			badUsage(err.Error())
+		}
+		os.Stdout.Write(data)
+		return
+	}
+
+	if _, err := exec.LookPath(goBin); err != nil {
+		badUsage(fmt.Sprintf("go command %q not found: %v", goBin, err))
+	}
+
+	if opts.Undo != "" {
+		dstDir := filepath.Dir(opts.Undo)
+		if len(args) > 0 {
+			dstDir = args[0]
+		}
+		if err := undo(opts.Undo, dstDir, opts.Force); err != nil {
+			logger.Error(fmt.Sprintf("%+v", err))
+			os.Exit(1)
+		}
+		return
+	}
+
+	if stdin {
+		if len(args) > 0 || opts.SrcPkg != "" || opts.Replay != "" {
+			badUsage("-stdin cannot be combined with SRCDIR, DSTDIR, -src-pkg, or -replay")
+		}
+		if err := batch(os.Stdin, opts); err != nil {
+			logger.Error(fmt.Sprintf("%+v", err))
+			os.Exit(1)
+		}
+		return
+	}
+
+	var srcDir, dstDir string
 	switch {
+	case opts.Replay != "":
+		// The source and destination come from the plan.
+	case opts.SrcPkg != "" && len(args) < 1:
+		badUsage("missing destination directory (DSTDIR)")
+	case opts.SrcPkg != "":
+		dstDir = args[0]
 	case len(args) < 1:
 		badUsage("missing source package (SRCDIR)")
 	case len(args) < 2:
 		badUsage("missing destination directory (DSTDIR)")
+	default:
+		srcDir = args[0]
+		dstDir = args[1]
 	}
 
-	srcDir := args[0]
-	dstDir := args[1]
-
 	if err := run(dstDir, srcDir, opts); err != nil {
-		log.Fatalf("%+v", err)
+		logger.Error(fmt.Sprintf("%+v", err))
+		os.Exit(1)
+	}
+}
+
+// envOr returns the value of the environment variable, or def if it is unset
+// or empty.
+func envOr(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
 	}
+	return def
+}
+
+// envExemptFlags are the flags that cannot be set from the environment or the
+// config file, since they select a different mode of operation or bypass
+// safety checks.
+var envExemptFlags = map[string]bool{
+	"undo":               true,
+	"print-schema":       true,
+	"force":              true,
+	"emit-plan":          true,
+	"replay":             true,
+	"stdin":              true,
+	"commit-allow-dirty": true,
+}
+
+// envFlagName returns the environment variable that provides the default for
+// the flag, e.g. MIRAGE_DST_MODULE for -dst-module.
+func envFlagName(name string) string {
+	return "MIRAGE_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyEnvDefaults sets each flag not given on the command line from its
+// environment variable, if set. Repeatable flags take a comma-separated list
+// of values.
+func applyEnvDefaults(fs *flag.FlagSet) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		// MIRAGE_GO names the go command for -go-bin, so -go has no
+		// variable of its own.
+		if err != nil || given[f.Name] || envExemptFlags[f.Name] || f.Name == "go" {
+			return
+		}
+		name := envFlagName(f.Name)
+		value := os.Getenv(name)
+		if value == "" {
+			return
+		}
+		values := []string{value}
+		if _, ok := f.Value.(*stringsFlag); ok {
+			values = strings.Split(value, ",")
+		}
+		for _, value := range values {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value %q for $%s: %v", value, name, setErr)
+				return
+			}
+		}
+	})
+	return err
 }
 
 func badUsage(why string) {
 	fmt.Fprintf(os.Stderr, "%s\n", why)
-	fmt.Fprintln(os.Stderr, "mirage [-dst-module=DSTMODULE] [-local-imports=<true/false>] SRCDIR DSTDIR")
+	fmt.Fprintln(os.Stderr, "mirage [flags] -src-pkg=IMPORTPATH DSTDIR")
+	fmt.Fprintln(os.Stderr, "mirage -undo=MANIFEST [-force] [DSTDIR]")
+	fmt.Fprintln(os.Stderr, "mirage -replay=PLAN [flags]")
+	fmt.Fprintln(os.Stderr, "mirage -stdin [flags] < TRANSPLANTS")
+	fmt.Fprintln(os.Stderr, "mirage -print-schema=manifest|config")
+	fmt.Fprintln(os.Stderr, "mirage [-dst-module=DSTMODULE] [-src-module=SRCMODULE] [-in-repo-prefix=PREFIX]... [-local-imports=<true/false/PREFIX>] [-local-prefix=PREFIX] [-go=VERSION] [-init] [-add-replace=OLD=NEW]... [-src-rev=REV [-diff-rev=REV]] [-patch=FILE] [-dry-run] [-emit-plan=PATH] [-all-packages] [-tests] [-only-platform=GOOS/GOARCH] [-golist-flags=FLAGS] [-analyze-tags] [-ignore-tagged=copy|deps|drop] [-mirror-src-path] [-eol=lf|crlf|preserve] [-preserve-symlinks] [-file-mode=MODE] [-dir-mode=MODE] [-vendor-mode] [-merge] [-mirror] [-since=REV] [-watch] [-manifest=PATH] [-shared-manifest=PATH]... [-summary-json=PATH] [-count-loc] [-prune-other] [-keep-empty-dirs] [-allow-empty] [-rewrite-asm] [-flatten-deps] [-allow-export-rename] [-format-generated] [-check-fmt] [-no-import-prune] [-prefer-source-order] [-map=SRC=DST]... [-map-file=PATH] [-rename-pkg=IMPORTPATH=NEWNAME]... [-report-unused-mappings] [-strict] [-tidy-errors=fail|continue] [-no-tidy-download] [-fmt-gomod] [-require-go=VERSION] [-verify] [-api-dump=PATH] [-tidy-order=before|after] [-dst-internal-depth=N] [-max-dep-packages=N] [-provenance] [-other-ext-allow=EXTS] [-other-ext-deny=EXTS] [-warn-textual] [-check-proto] [-extra-file=SRCREL[:DSTREL]]... [-fan-out=DIR[=MODULE]]... [-commit[=MESSAGE] [-branch=NAME] [-commit-allow-dirty]] [-log-format=text|json] [-log-file=PATH] [-no-timestamps] SRCDIR DSTDIR")
 	os.Exit(1)
 }
 
 type Options struct {
-	DstModule    string
-	LocalImports bool
+	DstModule            string
+	SrcModule            string
+	LocalImports         bool
+	GoVersion            string
+	Merge                bool
+	WarnTextual          bool
+	ExtraFiles           []string
+	Manifest             string
+	PruneOther           bool
+	RewriteAsm           bool
+	FlattenDeps          bool
+	FormatGenerated      bool
+	Mappings             []string
+	MapFile              string
+	Strict               bool
+	DstInternalDepth     int
+	ReportUnusedMappings bool
+	Provenance           bool
+	OtherExtAllow        string
+	OtherExtDeny         string
+	LocalPrefix          string
+	Undo                 string
+	Force                bool
+	Mirror               bool
+	SrcPkg               string
+	Tests                bool
+	EOL                  string
+	MirrorSrcPath        bool
+	SrcRev               string
+	DiffRev              string
+	NoImportPrune        bool
+	MaxDepPackages       int
+	PackageRenames       []string
+	OnlyPlatform         string
+	CheckFmt             bool
+	AddReplaces          []string
+	TidyErrors           string
+	Patch                string
+	NoTidyDownload       bool
+	CheckProto           bool
+	SummaryJSON          string
+	AllPackages          bool
+	PreserveSymlinks     bool
+	FileMode             os.FileMode
+	DirMode              os.FileMode
+	Watch                bool
+	DryRun               bool
+	VendorMode           bool
+	AllowExportRename    bool
+	EmitPlan             string
+	Replay               string
+	Since                string
+	SharedManifests      []string
+	Verify               bool
+	TidyOrder            string
+	APIDump              string
+	Init                 bool
+	AnalyzeTags          bool
+	FmtGoMod             bool
+	GoListFlags          string
+	FanOut               []string
+	RequireGo            string
+	KeepEmptyDirs        bool
+	AllowEmpty           bool
+	Packages             map[string]PackageOverride
+	IgnoreTagged         string
+	InRepoPrefixes       []string
+	Commit               bool
+	CommitMessage        string
+	Branch               string
+	CommitAllowDirty     bool
+	CountLOC             bool
+	PreferSourceOrder    bool
+
+	// Logger, if set, receives progress events in place of the default
+	// logger, which writes to stderr.
+	Logger *slog.Logger `json:"-"`
+
+	// Resolver, if set, is consulted for every package the transplanted
+	// packages import, in place of the built-in classification of in-module
+	// dependencies and their placement beneath internal/. It returns whether
+	// the package is copied and, if so, the import path it is given and its
+	// directory relative to DSTDIR. Packages it does not copy keep their
+	// import paths.
+	Resolver func(srcImportPath string) (dstImportPath, dstDir string, copy bool, err error)
+
+	// ExecObserver, if set, is called after each external command (go,
+	// goimports, git) that mirage runs, with the command line, the directory
+	// it ran in, how long it took, and the error it failed with, if any.
+	ExecObserver func(cmd []string, dir string, dur time.Duration, err error)
+}
+
+// stringsFlag is a repeatable flag that collects each value.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// localImportsFlag is the -local-imports flag. It is a boolean flag that also
+// accepts the prefix to group local imports by, which sets -local-prefix.
+type localImportsFlag Options
+
+func (f *localImportsFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	if f.LocalPrefix != "" {
+		return f.LocalPrefix
+	}
+	return strconv.FormatBool(f.LocalImports)
+}
+
+func (f *localImportsFlag) Set(value string) error {
+	if b, err := strconv.ParseBool(value); err == nil {
+		f.LocalImports = b
+		return nil
+	}
+	if value == "" {
+		return errors.New("expected true, false, or an import path prefix")
+	}
+	f.LocalImports = true
+	f.LocalPrefix = value
+	return nil
+}
+
+func (f *localImportsFlag) IsBoolFlag() bool {
+	return true
 }
 
 func run(dstDir, srcDir string, opts *Options) error {
-	log.Println("Building work...")
-	work, err := getWork(dstDir, srcDir, opts)
+	execObserver = opts.ExecObserver
+	if opts.Logger != nil {
+		logger = opts.Logger
+	}
+	if err := setModes(opts); err != nil {
+		return err
+	}
+
+	if opts.Replay != "" {
+		return replay(opts.Replay, opts)
+	}
+
+	if opts.SrcPkg != "" {
+		logger.Info("Resolving source package...")
+		var err error
+		if root, ok := srcPkgPattern(opts.SrcPkg); ok {
+			srcDir, err = resolveSrcPattern(opts.SrcPkg, root)
+		} else {
+			srcDir, err = resolveSrcPkg(opts.SrcPkg)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(opts.FanOut) > 0 && (opts.DiffRev != "" || opts.Patch != "" || opts.DryRun || opts.Watch) {
+		return errors.New("-fan-out cannot be combined with -diff-rev, -patch, -dry-run, or -watch")
+	}
+
+	if (opts.Branch != "" || opts.CommitAllowDirty) && !opts.Commit {
+		return errors.New("-branch and -commit-allow-dirty require -commit")
+	}
+	if opts.Commit && (opts.DiffRev != "" || opts.Patch != "" || opts.DryRun || opts.Watch || opts.EmitPlan != "" || len(opts.FanOut) > 0) {
+		return errors.New("-commit cannot be combined with -diff-rev, -patch, -dry-run, -watch, -emit-plan, or -fan-out")
+	}
+
+	// The sandbox copy of DSTDIR is no longer within the enclosing module
+	// whose import path -vendor-mode relies on.
+	if opts.VendorMode && (opts.Patch != "" || opts.DryRun) {
+		return errors.New("-vendor-mode cannot be combined with -patch or -dry-run")
+	}
+
+	// The plan would name files in the temporary checkout of the revision,
+	// which is removed once planning finishes.
+	if opts.EmitPlan != "" && opts.SrcRev != "" {
+		return errors.New("-emit-plan cannot be combined with -src-rev")
+	}
+
+	if opts.DiffRev != "" {
+		return diffRevs(dstDir, srcDir, opts)
+	}
+
+	if opts.SrcRev != "" {
+		logger.Info("Checking out source revision...", "rev", opts.SrcRev)
+		revSrcDir, cleanup, err := checkoutSrcRev(srcDir, opts.SrcRev)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		srcDir = revSrcDir
+	}
+
+	if opts.Patch != "" {
+		return writePatch(dstDir, srcDir, opts)
+	}
+
+	if opts.DryRun {
+		return dryRun(dstDir, srcDir, opts)
+	}
+
+	if opts.Watch {
+		return watch(dstDir, srcDir, opts)
+	}
+
+	if opts.EmitPlan != "" {
+		return emitPlan(dstDir, srcDir, opts.EmitPlan, opts)
+	}
+
+	if len(opts.FanOut) > 0 {
+		return fanOut(dstDir, srcDir, opts)
+	}
+
+	if opts.Commit {
+		if err := prepareCommit(dstDir, opts); err != nil {
+			return err
+		}
+	}
+	work, err := transplant(dstDir, srcDir, opts)
 	if err != nil {
 		return err
 	}
+	if opts.Commit {
+		return commitTransplant(work, opts)
+	}
+	return nil
+}
+
+// transplant plans and performs the transplant, returning the work done.
+func transplant(dstDir, srcDir string, opts *Options) (*Work, error) {
+	if opts.Init {
+		if err := initDst(dstDir, opts); err != nil {
+			return nil, err
+		}
+	}
 
-	return doWork(work, opts)
+	logger.Info("Building work...")
+	work, err := getWork(dstDir, srcDir, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("Checking destination is writable...")
+	if err := checkDstWritable(work.DstDir); err != nil {
+		return nil, err
+	}
+
+	return work, doWork(work, opts)
 }
 
 func doWork(work *Work, opts *Options) error {
-	log.Println("Cleaning destination...")
-	if err := cleanDst(work.DstDir); err != nil {
-		return fmt.Errorf("failed to clean destination: %w", err)
+	start := time.Now()
+
+	// An empty plan would otherwise clean the destination and copy nothing.
+	if len(work.GoFiles) == 0 && !opts.AllowEmpty {
+		return fmt.Errorf("refusing to transplant no Go files (use -allow-empty to proceed anyway): %s", emptyPlanReason(work))
+	}
+	manifestPath := manifestPath(work, opts)
+	fingerprint := planFingerprint(work, opts)
+	toolchain, err := getToolchain(opts)
+	if err != nil {
+		return err
+	}
+
+	var priorRequires map[string]string
+	if opts.SummaryJSON != "" {
+		var err error
+		priorRequires, err = getRequires(work.DstDir)
+		if err != nil {
+			return fmt.Errorf("failed to read destination requirements: %w", err)
+		}
+	}
+
+	var unchanged map[string]bool
+	if opts.Mirror {
+		if manifestPath == "" {
+			return errors.New("-mirror requires -manifest")
+		}
+		prior, err := readManifest(manifestPath)
+		if err != nil {
+			return fmt.Errorf("failed to read prior manifest: %w", err)
+		}
+		if prior != nil {
+			logger.Info("Reconciling destination with prior manifest...")
+			unchanged, err = reconcileMirror(work, prior, fingerprint)
+			if err != nil {
+				return fmt.Errorf("failed to reconcile destination: %w", err)
+			}
+			logger.Info("Skipping unchanged files", "files", len(unchanged))
+		}
+	}
+	if opts.Since != "" {
+		var err error
+		unchanged, err = sinceUnchanged(work, manifestPath, fingerprint, opts.Since)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.PruneOther && !opts.Mirror {
+		if manifestPath == "" {
+			return errors.New("-prune-other requires -manifest")
+		}
+		prior, err := readManifest(manifestPath)
+		if err != nil {
+			return fmt.Errorf("failed to read prior manifest: %w", err)
+		}
+		if prior != nil {
+			logger.Info("Pruning stale non-Go files...")
+			pruned, err := pruneStaleOtherFiles(work, prior)
+			if err != nil {
+				return fmt.Errorf("failed to prune stale non-Go files: %w", err)
+			}
+			for _, dst := range pruned {
+				logger.Info("Pruned stale file", "dst", dst)
+			}
+			work.removed = append(work.removed, pruned...)
+		}
 	}
 
-	log.Println("Preparing go.mod...")
-	if err := copyOtherFile(work.SrcGoMod, work.DstGoMod); err != nil {
-		return fmt.Errorf("failed to copy go.mod: %v", err)
+	var emptied []string
+	if !opts.Merge && !opts.Mirror && opts.Since == "" {
+		logger.Info("Cleaning destination...")
+		shared, err := readSharedManifests(work.DstDir, opts.SharedManifests)
+		if err != nil {
+			return err
+		}
+		var removed []string
+		removed, emptied, err = cleanDst(work.DstDir, shared, opts.KeepEmptyDirs)
+		if err != nil {
+			return fmt.Errorf("failed to clean destination: %w", err)
+		}
+		work.removed = append(work.removed, removed...)
 	}
-	if err := execInDir(work.DstDir, "go", "mod", "edit", "-module", work.DstModule); err != nil {
-		return fmt.Errorf("failed to rename destination module: %w", err)
+
+	// When merging, an existing destination go.mod is kept as-is and tidy
+	// takes care of any requirements the transplanted code introduces. In
+	// vendor mode, no go.mod is touched at all.
+	if !opts.VendorMode && (!opts.Merge || !fileExists(work.DstGoMod)) {
+		logger.Info("Preparing go.mod...")
+		if err := copyOtherFile(work.SrcGoMod, work.DstGoMod); err != nil {
+			return fmt.Errorf("failed to copy go.mod: %v", err)
+		}
+		if work.DstModule != work.SrcModule {
+			if err := execInDir(work.DstDir, goBin, "mod", "edit", "-module", work.DstModule); err != nil {
+				return fmt.Errorf("failed to rename destination module: %w", err)
+			}
+		}
+		if err := resetGoSum(work, opts); err != nil {
+			return err
+		}
+	}
+	if opts.GoVersion != "" && !opts.VendorMode {
+		if err := execInDir(work.DstDir, goBin, "mod", "edit", "-go", opts.GoVersion); err != nil {
+			return fmt.Errorf("failed to set destination go version: %w", err)
+		}
+	}
+	for _, replace := range work.Replaces {
+		logger.Debug("Adding replace directive", "replace", replace)
+		if err := execInDir(work.DstDir, goBin, "mod", "edit", "-replace", replace); err != nil {
+			return fmt.Errorf("failed to add replace directive %q: %w", replace, err)
+		}
 	}
 
 	// Prepare package name replacements
-	log.Println("Copying Go source files...")
-	r := strings.NewReplacer(work.PackageReplacements...)
-	localModule := ""
-	if opts.LocalImports {
-		localModule = work.DstModule
-	}
-	for src, dst := range work.GoFiles {
-		if err := copyGoFile(src, dst, r, localModule); err != nil {
+	logger.Info("Copying Go source files...")
+	goCopier := newGoFileCopier(work, opts)
+	for _, src := range sortedKeys(work.GoFiles) {
+		dst := work.GoFiles[src]
+		if unchanged[dst] {
+			continue
+		}
+		logger.Debug("Copying Go source file", "src", src, "dst", dst)
+		if err := goCopier.copyGoFile(src, dst); err != nil {
+			return err
+		}
+	}
+
+	logger.Info("Copying non-Go source files...")
+	for _, src := range sortedKeys(work.OtherFiles) {
+		dst := work.OtherFiles[src]
+		if unchanged[dst] {
+			continue
+		}
+		if opts.PreserveSymlinks && isSymlink(src) {
+			logger.Debug("Copying symlink", "src", src, "dst", dst)
+			if err := work.copySymlink(src, dst); err != nil {
+				return err
+			}
+			continue
+		}
+		logger.Debug("Copying non-Go source file", "src", src, "dst", dst)
+		// Testdata fixtures are copied byte-for-byte.
+		verbatim := isTestdataPath(src)
+		copyFile := copyOtherFile
+		if opts.RewriteAsm && filepath.Ext(src) == ".s" && !verbatim {
+			copyFile = func(src, dst string) error {
+				return copyAsmFile(src, dst, goCopier.paths)
+			}
+		}
+		if err := copyFile(src, dst); err != nil {
+			return err
+		}
+		if opts.EOL != "" && !verbatim {
+			if err := normalizeFileEOL(dst, opts.EOL); err != nil {
+				return err
+			}
+		}
+	}
+
+	if opts.KeepEmptyDirs {
+		var prior *Manifest
+		if manifestPath != "" {
+			var err error
+			prior, err = readManifest(manifestPath)
+			if err != nil {
+				return fmt.Errorf("failed to read prior manifest: %w", err)
+			}
+		}
+		if err := work.keepEmptyDirs(emptied, prior); err != nil {
+			return err
+		}
+	}
+
+	if len(work.GeneratedFiles) > 0 {
+		logger.Info("Writing generated files...")
+		for _, dst := range sortedKeys(work.GeneratedFiles) {
+			if unchanged[dst] {
+				continue
+			}
+			logger.Debug("Writing generated file", "dst", dst)
+			if err := writeGeneratedFile(dst, work.GeneratedFiles[dst]); err != nil {
+				return err
+			}
+		}
+	}
+
+	if opts.CheckFmt {
+		logger.Info("Checking formatting...")
+		unformatted, err := work.unformattedGoFiles(opts.PreferSourceOrder)
+		if err != nil {
+			return err
+		}
+		if len(unformatted) > 0 {
+			return fmt.Errorf("destination Go files are not gofmt-clean:\n  %s", strings.Join(unformatted, "\n  "))
+		}
+	}
+
+	if err := tidyAndVerify(work, opts); err != nil {
+		return err
+	}
+	if opts.FmtGoMod && !opts.VendorMode {
+		if err := execInDir(work.DstDir, goBin, "mod", "edit", "-fmt"); err != nil {
+			return fmt.Errorf("failed to format destination go.mod: %w", err)
+		}
+	}
+
+	if opts.APIDump != "" {
+		if err := apiDump(work, opts.APIDump, opts.Strict); err != nil {
+			return err
+		}
+	}
+
+	var loc *LOC
+	if opts.CountLOC {
+		logger.Info("Counting lines of code...")
+		loc, err = countLOC(work)
+		if err != nil {
 			return err
 		}
+		logger.Info("Counted lines of code", "total", loc.Total, "packages", len(loc.Packages))
 	}
 
-	log.Println("Copying non-Go source files...")
-	for src, dst := range work.OtherFiles {
-		if err := copyOtherFile(src, dst); err != nil {
+	if manifestPath != "" {
+		logger.Info("Writing manifest...")
+		manifest, err := buildManifest(work, fingerprint, toolchain)
+		if err != nil {
+			return fmt.Errorf("failed to build manifest: %w", err)
+		}
+		manifest.LOC = loc
+		if err := writeManifest(manifestPath, manifest); err != nil {
 			return err
 		}
 	}
 
-	log.Println("Tidying...")
-	if err := execInDir(work.DstDir, "go", "mod", "tidy"); err != nil {
-		return fmt.Errorf("failed to tidy: %w", err)
+	if opts.SummaryJSON != "" {
+		logger.Info("Writing summary...")
+		summary, err := buildSummary(work, priorRequires, time.Since(start))
+		if err != nil {
+			return err
+		}
+		summary.LOC = loc
+		if err := writeSummary(opts.SummaryJSON, summary); err != nil {
+			return err
+		}
+		work.summary = summary
 	}
 
-	log.Println("Done.")
+	logger.Info("Done.")
 	return nil
 }
 
@@ -111,102 +794,884 @@ type Work struct {
 	SrcDir              string
 	SrcGoMod            string
 	SrcImportPath       string
+	SrcModule           string
+	SrcModuleDir        string
 	DstDir              string
 	DstGoMod            string
 	DstModule           string
 	GoFiles             map[string]string
 	OtherFiles          map[string]string
 	PackageReplacements []string
+	Mappings            map[string]string
+	PackageRenames      map[string]string
+	Replaces            []string
+	Packages            []*WorkPackage
+
+	// EmbedRewrites maps each Go file whose //go:embed patterns need to be
+	// rewritten (because the embedded files were relocated) to the rewrites.
+	EmbedRewrites map[string]map[string]string
+
+	// GeneratedFiles holds the contents of files produced by mirage itself,
+	// keyed by destination path.
+	GeneratedFiles map[string][]byte
+
+	// FlattenDir and FlattenPath are the directory and import path of the
+	// package that in-module dependencies are flattened into, if any.
+	// FlattenedPackages maps the import path of each flattened package to its
+	// package name.
+	FlattenDir        string
+	FlattenPath       string
+	FlattenedPackages map[string]string
+
+	// SharedFiles lists the destination paths of files that another
+	// transplant sharing the destination already wrote with the same
+	// content. They are not copied again and are not managed by this
+	// transplant.
+	SharedFiles []string
+
+	// IdentRenames maps the source import path of each package with
+	// top-level identifiers renamed to avoid collisions (with -merge or
+	// -flatten-deps) from the old identifiers to the new.
+	IdentRenames map[string]map[string]string
+
+	// PackageDirs maps the source import path of each in-module dependency
+	// placed by a package override with an explicit directory to that
+	// directory.
+	PackageDirs map[string]string
+
+	// copiedTo maps each destination path to the source file copied there.
+	copiedTo map[string]string
+
+	// removed holds the destination files the run removed, whose deletions
+	// -commit stages.
+	removed []string
+
+	// excludedGoFiles holds the absolute paths of the source Go files that
+	// go list excluded from their package's build (by build constraints).
+	excludedGoFiles map[string]bool
+
+	// infos holds the package info listed while planning, which plans for
+	// other destinations of the same source reuse.
+	infos *packageInfoCache
+
+	// summary is the summary of the run, if one was written.
+	summary *Summary
+}
+
+// WorkPackage describes a source package being transplanted.
+type WorkPackage struct {
+	SrcImportPath string
+	DstImportPath string
+	SrcDir        string
+	DstDir        string
+	Name          string
+}
+
+// goVersionRE matches the versions accepted by the go.mod go directive.
+var goVersionRE = regexp.MustCompile(`^[1-9][0-9]*\.(0|[1-9][0-9]*)(\.(0|[1-9][0-9]*))?((rc|beta)[1-9][0-9]*)?$`)
+
+// addPackage records a source package being transplanted to the given
+// destination import path and directory.
+func (w *Work) addPackage(info *packageInfo, dstImportPath, dstDir string) {
+	w.Packages = append(w.Packages, &WorkPackage{
+		SrcImportPath: info.ImportPath,
+		DstImportPath: dstImportPath,
+		SrcDir:        info.Dir,
+		DstDir:        dstDir,
+		Name:          info.Name,
+	})
+	for _, file := range info.IgnoredGoFiles {
+		w.excludedGoFiles[filepath.Join(info.Dir, file)] = true
+	}
+}
+
+// dstPackageName returns the name the package is given in the destination,
+// which is the name from its package clause unless it is renamed or
+// flattened. Directory names are never assumed to match package names.
+func (w *Work) dstPackageName(pkg *WorkPackage) string {
+	switch {
+	case w.PackageRenames[pkg.SrcImportPath] != "":
+		return w.PackageRenames[pkg.SrcImportPath]
+	case w.FlattenDir != "" && pkg.DstDir == w.FlattenDir:
+		return flattenPackageName
+	default:
+		return pkg.Name
+	}
+}
+
+// packageForFile returns the transplanted package holding the source file, or
+// nil if there is none (e.g. for extra files). The files of the source
+// package may be relative to the working directory.
+func (w *Work) packageForFile(src string) *WorkPackage {
+	dir, err := filepath.Abs(filepath.Dir(src))
+	if err != nil {
+		return nil
+	}
+	for _, pkg := range w.Packages {
+		if pkg.SrcDir == dir {
+			return pkg
+		}
+	}
+	return nil
+}
+
+// addCopies records the copies of the package files, and of its testdata
+// files, from srcDir to dstDir. Testdata files are copied verbatim, even Go
+// files among them, since fixtures are not part of the package.
+func (w *Work) addCopies(srcDir, dstDir string, files, testdata []string) error {
+	for _, file := range files {
+		if err := w.addCopy(filepath.Join(srcDir, file), filepath.Join(dstDir, file)); err != nil {
+			return err
+		}
+	}
+	for _, file := range testdata {
+		if err := w.addVerbatimCopy(filepath.Join(srcDir, file), filepath.Join(dstDir, file)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addCopy records that the source file is copied to the destination path,
+// as a Go file to rewrite and format if it has a .go extension. It fails if
+// another source file is already copied there. The destination go.mod and
+// go.sum are only ever written by the dedicated go.mod handling, so copies
+// onto them are skipped.
+func (w *Work) addCopy(src, dst string) error {
+	return w.recordCopy(src, dst, filepath.Ext(src) == ".go")
+}
+
+// addVerbatimCopy is addCopy for a file that is copied as-is whatever its
+// extension.
+func (w *Work) addVerbatimCopy(src, dst string) error {
+	return w.recordCopy(src, dst, false)
+}
+
+func (w *Work) recordCopy(src, dst string, goFile bool) error {
+	if isDstModuleFile(w.DstDir, dst) {
+		logger.Debug("Skipping copy onto destination module file", "src", src, "dst", dst)
+		return nil
+	}
+	if other, ok := w.copiedTo[dst]; ok && other != src {
+		return fmt.Errorf("both %q and %q would be copied to %q; use -map, -dst-internal-depth, or an -extra-file DSTREL to give one of them a different destination", other, src, dst)
+	}
+	w.copiedTo[dst] = src
+	if goFile {
+		w.GoFiles[src] = dst
+	} else {
+		w.OtherFiles[src] = dst
+	}
+	return nil
+}
+
+// checkDstCollisions ensures each destination path is written by only one
+// source file, whether Go or not, or generated file. addCopy catches most
+// collisions as they are planned, but files are routed into GoFiles and
+// OtherFiles by extension and may be moved afterwards (e.g. by -merge), and a
+// replayed plan may have been edited.
+func (w *Work) checkDstCollisions() error {
+	writers := make(map[string]string)
+	var collisions []string
+	add := func(dst, src string) {
+		dst = filepath.Clean(dst)
+		if other, ok := writers[dst]; ok {
+			collisions = append(collisions, fmt.Sprintf("%s (from %s and %s)", dst, other, src))
+			return
+		}
+		writers[dst] = src
+	}
+	for _, src := range sortedKeys(w.GoFiles) {
+		add(w.GoFiles[src], src)
+	}
+	for _, src := range sortedKeys(w.OtherFiles) {
+		add(w.OtherFiles[src], src)
+	}
+	for _, dst := range sortedKeys(w.GeneratedFiles) {
+		add(dst, "generated content")
+	}
+	if len(collisions) > 0 {
+		return fmt.Errorf("multiple files would be written to the same destination:\n  %s", strings.Join(collisions, "\n  "))
+	}
+	return nil
+}
+
+func (w *Work) addPackageReplacement(srcPkg, dstPkg string) {
+	// Identity replacements (e.g. when relocating within the same module
+	// path) would only cause churn.
+	if srcPkg == dstPkg {
+		return
+	}
+	w.PackageReplacements = append(w.PackageReplacements, strconv.Quote(srcPkg), strconv.Quote(dstPkg))
+}
+
+// packagePaths returns the package replacements as a map from source import
+// path to destination import path.
+func (w *Work) packagePaths() map[string]string {
+	paths := make(map[string]string, len(w.PackageReplacements)/2)
+	for i := 0; i < len(w.PackageReplacements); i += 2 {
+		srcPkg, _ := strconv.Unquote(w.PackageReplacements[i])
+		dstPkg, _ := strconv.Unquote(w.PackageReplacements[i+1])
+		paths[srcPkg] = dstPkg
+	}
+	return paths
+}
+
+// checkGoSources checks the Go source files before anything is written, so
+// that -strict fails before the destination is touched. It reports every
+// source file that does not parse, then warns about the source import paths
+// -warn-textual finds outside of import declarations and, with
+// -report-unused-mappings, about the mappings no copied file imports.
+func (w *Work) checkGoSources(opts *Options) error {
+	paths := w.packagePaths()
+	used := make(map[string]int)
+	var unparsed []string
+	for _, src := range sortedKeys(w.GoFiles) {
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return errs.Wrap(err)
+		}
+
+		// Broken source files would otherwise only surface (if at all) as a
+		// confusing failure of a later rewriting or formatting step.
+		if _, err := parser.ParseFile(token.NewFileSet(), src, data, parser.SkipObjectResolution); err != nil {
+			if !opts.Strict {
+				logger.Warn("Source file does not parse as Go", "file", src, "err", err)
+			}
+			unparsed = append(unparsed, err.Error())
+			continue
+		}
+
+		if opts.WarnTextual {
+			matches, err := findTextualMatches(src, w.PackageReplacements)
+			if err != nil {
+				return fmt.Errorf("failed to check %q for textual import path matches: %w", src, err)
+			}
+			for _, match := range matches {
+				if err := warn(opts.Strict, "Source import path will be rewritten outside of an import declaration", "file", src, "line", match.Line, "path", match.Path); err != nil {
+					return err
+				}
+			}
+		}
+		countImports(used, paths, src, data)
+	}
+	if opts.Strict && len(unparsed) > 0 {
+		return fmt.Errorf("source files do not parse as Go:\n  %s", strings.Join(unparsed, "\n  "))
+	}
+	if opts.ReportUnusedMappings {
+		for _, src := range unusedMappings(w.Mappings, used) {
+			if err := warn(opts.Strict, "Mapping was never applied", "src", src, "dst", w.Mappings[src]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkDstImportPaths ensures no two transplanted packages are given the same
+// destination import path (other than those intentionally flattened into one
+// package), e.g. a custom mapping onto the path of an internal dependency, or
+// a dependency landing on the source package's own path.
+func (w *Work) checkDstImportPaths() error {
+	srcByDst := make(map[string]string)
+	var collisions []string
+	for _, pkg := range w.Packages {
+		if w.FlattenPath != "" && pkg.DstImportPath == w.FlattenPath {
+			continue
+		}
+		if other, ok := srcByDst[pkg.DstImportPath]; ok {
+			collisions = append(collisions, fmt.Sprintf("%s (from %s and %s)", pkg.DstImportPath, other, pkg.SrcImportPath))
+			continue
+		}
+		srcByDst[pkg.DstImportPath] = pkg.SrcImportPath
+	}
+	if len(collisions) > 0 {
+		return fmt.Errorf("multiple packages map to the same destination import path:\n  %s", strings.Join(collisions, "\n  "))
+	}
+	return nil
+}
+
+// inRepoSuffix returns the path of the dependency relative to the first of
+// the -in-repo-prefix prefixes it is beneath, which places it beneath
+// internal/ as the path relative to the module does for in-module
+// dependencies. A dependency that is itself one of the prefixes is placed at
+// its last element.
+func inRepoSuffix(dep string, prefixes []string) (string, bool) {
+	for _, prefix := range prefixes {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if dep == prefix {
+			return path.Base(dep), true
+		}
+		if suffix, ok := strings.CutPrefix(dep, prefix+"/"); ok {
+			return suffix, true
+		}
+	}
+	return "", false
 }
 
-func (w *Work) addCopies(srcDir, dstDir string, files []string) {
-	for _, file := range files {
-		src := filepath.Join(srcDir, file)
-		dst := filepath.Join(dstDir, file)
-		if filepath.Ext(file) == ".go" {
-			w.GoFiles[src] = dst
-		} else {
-			w.OtherFiles[src] = dst
+// dropInternalElems returns the import path suffix without its internal
+// elements (e.g. foo/bar for internal/foo/internal/bar).
+func dropInternalElems(suffix string) string {
+	var elems []string
+	for _, elem := range strings.Split(suffix, "/") {
+		if elem != "internal" {
+			elems = append(elems, elem)
+		}
+	}
+	return strings.Join(elems, "/")
+}
+
+// collapseSuffix returns the last depth elements of the import path suffix,
+// or the whole suffix if depth is zero.
+func collapseSuffix(suffix string, depth int) string {
+	elems := strings.Split(suffix, "/")
+	if depth == 0 || depth >= len(elems) {
+		return suffix
+	}
+	return strings.Join(elems[len(elems)-depth:], "/")
+}
+
+func getWork(dstDir, srcDir string, opts *Options) (*Work, error) {
+	return getWorkCached(dstDir, srcDir, opts, nil)
+}
+
+// getWorkCached is getWork, reusing the package info of a prior plan for the
+// same source and platform if one is given.
+func getWorkCached(dstDir, srcDir string, opts *Options, prior *Work) (_ *Work, err error) {
+	switch opts.EOL {
+	case "", eolLF, eolCRLF, eolPreserve:
+	default:
+		return nil, fmt.Errorf("invalid line ending style %q; expected lf, crlf, or preserve", opts.EOL)
+	}
+	var platformEnv []string
+	if opts.OnlyPlatform != "" {
+		goos, goarch, ok := strings.Cut(opts.OnlyPlatform, "/")
+		if !ok || goos == "" || goarch == "" || strings.Contains(goarch, "/") {
+			return nil, fmt.Errorf("invalid platform %q; expected GOOS/GOARCH", opts.OnlyPlatform)
+		}
+		platformEnv = []string{"GOOS=" + goos, "GOARCH=" + goarch}
+	}
+	switch opts.TidyErrors {
+	case "", tidyErrorsFail, tidyErrorsContinue:
+	default:
+		return nil, fmt.Errorf("invalid tidy error handling %q; expected fail or continue", opts.TidyErrors)
+	}
+	switch opts.TidyOrder {
+	case "", tidyOrderBefore, tidyOrderAfter:
+	default:
+		return nil, fmt.Errorf("invalid tidy order %q; expected before or after", opts.TidyOrder)
+	}
+	switch opts.IgnoreTagged {
+	case "", ignoreTaggedCopy, ignoreTaggedDeps, ignoreTaggedDrop:
+	default:
+		return nil, fmt.Errorf("invalid ignore-tagged handling %q; expected copy, deps, or drop", opts.IgnoreTagged)
+	}
+	if opts.Since != "" && (opts.Mirror || opts.Merge) {
+		return nil, errors.New("-since cannot be combined with -mirror or -merge")
+	}
+	if opts.AllPackages && (opts.FlattenDeps || opts.MirrorSrcPath || opts.SrcModule != "") {
+		return nil, errors.New("-all-packages cannot be combined with -flatten-deps, -mirror-src-path, or -src-module")
+	}
+	srcPattern, isPattern := srcPkgPattern(opts.SrcPkg)
+	if isPattern && (opts.AllPackages || opts.MirrorSrcPath || opts.SrcModule != "") {
+		return nil, errors.New("a -src-pkg pattern cannot be combined with -all-packages, -mirror-src-path, or -src-module")
+	}
+	if opts.MaxDepPackages < 0 {
+		return nil, fmt.Errorf("invalid dependency package limit %d; must not be negative", opts.MaxDepPackages)
+	}
+	if opts.DstInternalDepth < 0 {
+		return nil, fmt.Errorf("invalid internal depth %d; must not be negative", opts.DstInternalDepth)
+	}
+	if opts.GoVersion != "" && !goVersionRE.MatchString(opts.GoVersion) {
+		return nil, fmt.Errorf("invalid go version %q; expected a version like 1.21 or 1.21.0", opts.GoVersion)
+	}
+
+	work := &Work{
+		SrcDir:          srcDir,
+		DstDir:          dstDir,
+		DstGoMod:        filepath.Join(dstDir, "go.mod"),
+		GoFiles:         make(map[string]string),
+		OtherFiles:      make(map[string]string),
+		GeneratedFiles:  make(map[string][]byte),
+		EmbedRewrites:   make(map[string]map[string]string),
+		IdentRenames:    make(map[string]map[string]string),
+		PackageDirs:     make(map[string]string),
+		copiedTo:        make(map[string]string),
+		excludedGoFiles: make(map[string]bool),
+	}
+
+	if opts.VendorMode {
+		if opts.GoVersion != "" || len(opts.AddReplaces) > 0 {
+			return nil, errors.New("-vendor-mode cannot be combined with -go or -add-replace, which edit the destination go.mod")
+		}
+		if opts.DstModule == "" {
+			work.DstModule, err = vendorImportPath(dstDir)
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		work.DstModule, err = getModulePath(dstDir)
+		if err != nil && fileExists(filepath.Join(dstDir, "go.mod")) {
+			return nil, fmt.Errorf("failed to get package info for destination: %w", err)
+		}
+	}
+
+	switch {
+	case opts.DstModule != "":
+		work.DstModule = opts.DstModule
+	case work.DstModule == "":
+		return nil, errors.New("no destination module available; use --dst-module or create go.mod at the destination")
+	}
+
+	listFlags, cleanup, err := moduleCacheListFlags(srcDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for a module cache source: %w", err)
+	}
+	defer cleanup()
+	modCacheSrc := len(listFlags) > 0
+	for _, flag := range strings.Fields(opts.GoListFlags) {
+		name, _, _ := strings.Cut(strings.TrimLeft(flag, "-"), "=")
+		switch name {
+		case "json", "f", "m", "e", "find", "deps", "export", "compiled", "test":
+			return nil, fmt.Errorf("go list flag %q is not supported; mirage relies on the output it selects", flag)
+		}
+		listFlags = append(listFlags, flag)
+	}
+
+	infos := newPackageInfoCache(platformEnv)
+	if prior != nil && prior.SrcDir == srcDir && slices.Equal(prior.infos.env, platformEnv) {
+		infos = prior.infos
+	}
+	work.infos = infos
+	var srcInfo *packageInfo
+	if opts.AllPackages || isPattern {
+		srcInfo, err = getModuleInfo(srcDir, listFlags)
+	} else {
+		srcInfo, err = infos.get(srcDir, ".", listFlags)
+	}
+	switch {
+	case err != nil && !inModule(srcDir):
+		return nil, fmt.Errorf("source %q is not part of a Go module; GOPATH-style sources are not supported: %w", srcDir, err)
+	case err != nil:
+		return nil, fmt.Errorf("failed to get package info for source: %w", err)
+	case srcInfo.Module.Path == "" || srcInfo.Module.GoMod == "":
+		// go list succeeds outside of module mode (e.g. GO111MODULE=off) but
+		// leaves no go.mod to copy to the destination.
+		return nil, fmt.Errorf("source %q is not part of a Go module; GOPATH-style sources are not supported", srcDir)
+	}
+	work.SrcGoMod = srcInfo.Module.GoMod
+	if modCacheSrc {
+		// go list reports the writable copy passed via -modfile
+		work.SrcGoMod = filepath.Join(srcInfo.Module.Dir, "go.mod")
+	}
+	work.SrcImportPath = srcInfo.ImportPath
+	if isPattern {
+		work.SrcImportPath = srcPattern
+	}
+
+	srcModule := srcInfo.Module.Path
+	srcModuleDir := srcInfo.Module.Dir
+	if opts.SrcModule != "" {
+		rel, ok := strings.CutPrefix(work.SrcImportPath, opts.SrcModule)
+		if !ok || (rel != "" && !strings.HasPrefix(rel, "/")) {
+			return nil, fmt.Errorf("source module %q is not a prefix of the source import path %q", opts.SrcModule, work.SrcImportPath)
+		}
+		// Walk up from the source directory once per import path element
+		// beneath the overridden module to find its directory.
+		srcModuleDir, err = filepath.Abs(srcDir)
+		if err != nil {
+			return nil, errs.Wrap(err)
+		}
+		for i := strings.Count(rel, "/"); i > 0; i-- {
+			srcModuleDir = filepath.Dir(srcModuleDir)
+		}
+		srcModule = opts.SrcModule
+	}
+	work.SrcModule = srcModule
+	work.SrcModuleDir = srcModuleDir
+
+	work.Mappings, err = parseMappings(opts.Mappings, opts.MapFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := work.addPackageOverrides(opts.Packages); err != nil {
+		return nil, err
+	}
+	if _, ok := work.Mappings[work.SrcImportPath]; ok {
+		return nil, fmt.Errorf("cannot map the source package %q itself", work.SrcImportPath)
+	}
+	work.PackageRenames, err = parseRenames(opts.PackageRenames)
+	if err != nil {
+		return nil, err
+	}
+	work.Replaces, err = parseReplaces(opts.AddReplaces)
+	if err != nil {
+		return nil, err
+	}
+
+	var listed []*packageInfo
+	if opts.AllPackages || isPattern {
+		logger.Info("Listing module packages...")
+		listDir, base := srcModuleDir, srcModule
+		if isPattern {
+			listDir, base = srcDir, srcPattern
+		}
+		listed, err = listPackages(listDir, "./...", listFlags, platformEnv)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list source module packages: %w", err)
+		}
+		if len(listed) == 0 {
+			return nil, fmt.Errorf("no source packages found beneath %q", base)
+		}
+		if err := work.addModulePackages(listed, base, opts); err != nil {
+			return nil, err
+		}
+	} else {
+		// With -mirror-src-path the source package keeps its path beneath the
+		// module root rather than being placed at the destination root.
+		topDstPkg, topDstDir := work.DstModule, dstDir
+		if opts.MirrorSrcPath {
+			if rel := strings.TrimPrefix(strings.TrimPrefix(work.SrcImportPath, srcModule), "/"); rel != "" {
+				topDstPkg = path.Join(work.DstModule, rel)
+				topDstDir = filepath.Join(dstDir, filepath.FromSlash(rel))
+			}
+		}
+		work.addPackage(srcInfo, topDstPkg, topDstDir)
+		work.addPackageReplacement(work.SrcImportPath, topDstPkg)
+		logDroppedPlatformFiles(srcInfo, opts.OnlyPlatform)
+		srcFiles, srcTestdata, err := srcInfo.filesToCopy(opts.Tests, opts.OnlyPlatform != "", opts.IgnoreTagged, opts.PreserveSymlinks)
+		if err != nil {
+			return nil, err
+		}
+		if err := work.addCopies(srcDir, topDstDir, srcFiles, srcTestdata); err != nil {
+			return nil, err
+		}
+	}
+
+	extraSrcs := make(map[string]bool)
+	for _, extraFile := range opts.ExtraFiles {
+		srcRel, dstRel, ok := strings.Cut(extraFile, ":")
+		if !ok {
+			dstRel = srcRel
+		}
+		if !filepath.IsLocal(srcRel) || !filepath.IsLocal(dstRel) {
+			return nil, fmt.Errorf("invalid extra file %q: paths must be relative and within their module", extraFile)
+		}
+		if isDstModuleFile(dstDir, filepath.Join(dstDir, dstRel)) {
+			return nil, fmt.Errorf("invalid extra file %q: the destination %s is managed separately", extraFile, dstRel)
+		}
+		src := filepath.Join(srcModuleDir, srcRel)
+		if !fileExists(src) {
+			return nil, fmt.Errorf("extra file %q does not exist in the source module", srcRel)
+		}
+		if err := work.addCopy(src, filepath.Join(dstDir, dstRel)); err != nil {
+			return nil, err
+		}
+		extraSrcs[src] = true
+	}
+
+	next := make(map[string]struct{})
+	for _, dep := range srcInfo.imports(opts.Tests, opts.IgnoreTagged == ignoreTaggedDeps) {
+		next[dep] = struct{}{}
+	}
+
+	// The source package itself is never a dependency, even when its
+	// external tests import it. Neither are the listed packages, whose
+	// dependencies beneath no listed package are copied once for all.
+	done := map[string]struct{}{
+		work.SrcImportPath: {},
+	}
+	for _, info := range listed {
+		done[info.ImportPath] = struct{}{}
+	}
+	for _, info := range listed {
+		for _, dep := range info.imports(opts.Tests, opts.IgnoreTagged == ignoreTaggedDeps) {
+			next[dep] = struct{}{}
+		}
+	}
+	mapped := make(map[string]struct{})
+	var queued []string
+	dstSuffixes := make(map[string]string)
+
+	if opts.FlattenDeps {
+		work.FlattenDir = filepath.Join(dstDir, "internal", flattenPackageName)
+		work.FlattenPath = path.Join(work.DstModule, "internal", flattenPackageName)
+		work.FlattenedPackages = make(map[string]string)
+	}
+
+	// Figure out which deps are in-module and need to be copied
+	prefix := srcModule + "/"
+
+	// Each round of dependencies is processed in import path order so that
+	// the replacements, and everything derived from them, are the same from
+	// run to run.
+	for len(next) > 0 {
+		deps := next
+		next = make(map[string]struct{})
+		for _, dep := range sortedKeys(deps) {
+			// A package reached more than once (e.g. imported by both a
+			// package and a test) is classified and copied only the first
+			// time, with the same file set however it was reached.
+			if _, ok := done[dep]; ok {
+				continue
+			}
+			done[dep] = struct{}{}
+
+			// A custom resolver replaces the classification and placement of
+			// dependencies entirely.
+			var resolvedPkg, resolvedDir string
+			if opts.Resolver != nil {
+				dstPkg, dstRel, copy, err := opts.Resolver(dep)
+				switch {
+				case err != nil:
+					return nil, fmt.Errorf("failed to resolve dependency package %q: %w", dep, err)
+				case !copy:
+					continue
+				case dstPkg == "" || !filepath.IsLocal(filepath.FromSlash(dstRel)):
+					return nil, fmt.Errorf("resolver placed dependency package %q at %q in %q; expected an import path and a directory within DSTDIR", dep, dstPkg, dstRel)
+				}
+				resolvedPkg, resolvedDir = dstPkg, filepath.Join(dstDir, filepath.FromSlash(dstRel))
+			}
+
+			suffix, cut := strings.CutPrefix(dep, prefix)
+			inRepo := false
+			if !cut {
+				suffix, cut = inRepoSuffix(dep, opts.InRepoPrefixes)
+				inRepo = cut
+			}
+			switch {
+			case resolvedPkg != "":
+				suffix = dep
+			case !cut:
+				continue
+			}
+
+			queued = append(queued, dep)
+			if opts.MaxDepPackages > 0 && len(queued) > opts.MaxDepPackages {
+				sample := queued
+				if len(sample) > 10 {
+					sample = sample[:10]
+				}
+				return nil, fmt.Errorf("more than %d in-module dependency packages queued (raise -max-dep-packages if this is intended); first %d:\n  %s", opts.MaxDepPackages, len(sample), strings.Join(sample, "\n  "))
+			}
+
+			// Resolve the dependency by import path from the source package
+			// so its directory comes from go list rather than assuming the
+			// layout on disk mirrors the import path.
+			depInfo, err := infos.get(srcDir, dep, listFlags)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get package info for dependency package %q: %w", suffix, err)
+			}
+
+			// An import path beneath the source module path may still belong
+			// to another module, such as a major version sibling (mod/v2) or
+			// a nested module, which is an external dependency like any other
+			// and keeps its import path.
+			if resolvedPkg == "" && !inRepo && depInfo.Module.Path != "" && srcInfo.Module.Path != "" && depInfo.Module.Path != srcInfo.Module.Path {
+				logger.Debug("Skipping dependency from another module", "pkg", dep, "module", depInfo.Module.Path)
+				queued = queued[:len(queued)-1]
+				continue
+			}
+			depSrcDir := depInfo.Dir
+			logDroppedPlatformFiles(depInfo, opts.OnlyPlatform)
+			depFiles, depTestdata, err := depInfo.filesToCopy(opts.Tests, opts.OnlyPlatform != "", opts.IgnoreTagged, opts.PreserveSymlinks)
+			if err != nil {
+				return nil, err
+			}
+
+			// Deps is already transitive, but test imports are not, so
+			// queue up the imports of every dependency too.
+			for _, imp := range depInfo.imports(opts.Tests, opts.IgnoreTagged == ignoreTaggedDeps) {
+				next[imp] = struct{}{}
+			}
+
+			if resolvedPkg != "" {
+				logger.Debug("Adding resolved dependency package", "pkg", depInfo.ImportPath, "src", depSrcDir, "dst", resolvedDir)
+				work.addPackage(depInfo, resolvedPkg, resolvedDir)
+				work.addPackageReplacement(depInfo.ImportPath, resolvedPkg)
+				if err := work.addCopies(depSrcDir, resolvedDir, depFiles, depTestdata); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			// Custom mappings relocate in-module dependencies anywhere
+			// within the destination module.
+			if dstPkg, ok := work.Mappings[dep]; ok {
+				depDstDir, ok := work.PackageDirs[dep]
+				if !ok {
+					rel, ok := strings.CutPrefix(dstPkg, work.DstModule+"/")
+					if !ok {
+						return nil, fmt.Errorf("mapping for in-module dependency %q must be within the destination module %q", dep, work.DstModule)
+					}
+					depDstDir = filepath.Join(dstDir, filepath.FromSlash(rel))
+				}
+				logger.Debug("Adding dependency package", "pkg", depInfo.ImportPath, "src", depSrcDir, "dst", depDstDir)
+				work.addPackage(depInfo, dstPkg, depDstDir)
+				work.addPackageReplacement(depInfo.ImportPath, dstPkg)
+				if err := work.addCopies(depSrcDir, depDstDir, depFiles, depTestdata); err != nil {
+					return nil, err
+				}
+				mapped[dep] = struct{}{}
+				continue
+			}
+
+			if opts.FlattenDeps {
+				logger.Debug("Adding dependency package", "pkg", depInfo.ImportPath, "src", depSrcDir, "dst", work.FlattenDir)
+				work.FlattenedPackages[depInfo.ImportPath] = depInfo.Name
+				work.addPackage(depInfo, work.FlattenPath, work.FlattenDir)
+				work.addPackageReplacement(depInfo.ImportPath, work.FlattenPath)
+				if err := work.addFlattenedCopies(depSrcDir, suffix, depFiles, depTestdata); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			// Dependencies are already copied beneath internal/, so internal
+			// elements in the source path would only be doubled up. Dropping
+			// them can only widen visibility within the destination module,
+			// never narrow it.
+			dstSuffix := collapseSuffix(dropInternalElems(suffix), opts.DstInternalDepth)
+			if other, ok := dstSuffixes[dstSuffix]; ok {
+				return nil, fmt.Errorf("dependency packages %q and %q both map to internal/%s; increase -dst-internal-depth", other, dep, dstSuffix)
+			}
+			dstSuffixes[dstSuffix] = dep
+
+			depDstDir := filepath.Join(dstDir, "internal", filepath.FromSlash(dstSuffix))
+
+			logger.Debug("Adding dependency package", "pkg", depInfo.ImportPath, "src", depSrcDir, "dst", depDstDir)
+			work.addPackage(depInfo, path.Join(work.DstModule, "internal", dstSuffix), depDstDir)
+			work.addPackageReplacement(depInfo.ImportPath, path.Join(work.DstModule, "internal", dstSuffix))
+			if err := work.addCopies(depSrcDir, depDstDir, depFiles, depTestdata); err != nil {
+				return nil, err
+			}
 		}
 	}
-}
-
-func (w *Work) addPackageReplacement(srcPkg, dstPkg string) {
-	w.PackageReplacements = append(w.PackageReplacements, strconv.Quote(srcPkg), strconv.Quote(dstPkg))
-}
 
-func getWork(dstDir, srcDir string, opts *Options) (_ *Work, err error) {
-	work := &Work{
-		SrcDir:     srcDir,
-		DstDir:     dstDir,
-		DstGoMod:   filepath.Join(dstDir, "go.mod"),
-		GoFiles:    make(map[string]string),
-		OtherFiles: make(map[string]string),
+	if err := work.checkDstImportPaths(); err != nil {
+		return nil, err
 	}
 
-	work.DstModule, err = getModulePath(dstDir)
-	if err != nil && fileExists(filepath.Join(dstDir, "go.mod")) {
-		return nil, fmt.Errorf("failed to get package info for destination: %w", err)
+	// Any remaining custom mappings only rewrite imports
+	for _, src := range sortedKeys(work.Mappings) {
+		if _, ok := mapped[src]; !ok {
+			work.addPackageReplacement(src, work.Mappings[src])
+		}
 	}
 
-	switch {
-	case opts.DstModule != "":
-		work.DstModule = opts.DstModule
-	case work.DstModule == "":
-		return nil, errors.New("no destination module available; use --dst-module or create go.mod at the destination")
+	if opts.FlattenDeps {
+		if err := work.checkFlattenedDecls(opts.AllowExportRename); err != nil {
+			return nil, err
+		}
+	}
+	if err := work.checkRenames(); err != nil {
+		return nil, err
 	}
 
-	srcInfo, err := getPackageInfo(srcDir)
+	allowExts, err := parseExtList(opts.OtherExtAllow)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get package info for source: %w", err)
+		return nil, fmt.Errorf("invalid -other-ext-allow: %w", err)
 	}
-	work.SrcGoMod = srcInfo.Module.GoMod
-	work.SrcImportPath = srcInfo.ImportPath
-	work.addPackageReplacement(work.SrcImportPath, work.DstModule)
-	work.addCopies(srcDir, dstDir, srcInfo.AllFiles())
-
-	next := make(map[string]struct{})
-	for _, dep := range srcInfo.Deps {
-		next[dep] = struct{}{}
+	denyExts, err := parseExtList(opts.OtherExtDeny)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -other-ext-deny: %w", err)
 	}
+	work.filterOtherFiles(allowExts, denyExts, extraSrcs)
 
-	done := make(map[string]struct{})
+	if err := work.checkEmbeds(opts.Strict); err != nil {
+		return nil, err
+	}
 
-	// Figure out which deps are in-module and need to be copied
-	prefix := srcInfo.Module.Path + "/"
+	missing, err := work.missingGenerateOutputs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to check go:generate outputs: %w", err)
+	}
+	for _, m := range missing {
+		if err := warn(opts.Strict, "go:generate output is not present in the source; run go generate there before transplanting", "directive", m); err != nil {
+			return nil, err
+		}
+	}
 
-	for len(next) > 0 {
-		deps := next
-		next = make(map[string]struct{})
-		for dep := range deps {
-			if _, ok := done[dep]; ok {
-				continue
+	if opts.CheckProto {
+		refs, err := work.protoDescriptorPaths()
+		if err != nil {
+			return nil, fmt.Errorf("failed to check protobuf descriptors: %w", err)
+		}
+		for _, src := range sortedKeys(refs) {
+			if err := warn(opts.Strict, "Generated protobuf file references source import paths in its descriptor; regenerate it with an updated go_package to avoid registration mismatches", "file", src, "paths", refs[src]); err != nil {
+				return nil, err
 			}
-			done[dep] = struct{}{}
+		}
+	}
 
-			suffix, cut := strings.CutPrefix(dep, prefix)
-			if !cut {
-				continue
+	if opts.AnalyzeTags {
+		unbuildable, err := work.unbuildableFiles(opts.OnlyPlatform, opts.GoListFlags)
+		if err != nil {
+			return nil, fmt.Errorf("failed to analyze build constraints: %w", err)
+		}
+		for _, src := range unbuildable {
+			if err := warn(opts.Strict, "Copied file is excluded by its build constraints for the destination platform and tags; consider excluding it", "file", src); err != nil {
+				return nil, err
 			}
+		}
+	}
 
-			depSrcDir := filepath.Join(srcInfo.Module.Dir, suffix)
-			depDstDir := filepath.Join(dstDir, "internal", suffix)
+	if err := work.checkGoSources(opts); err != nil {
+		return nil, err
+	}
 
-			depInfo, err := getPackageInfo(depSrcDir)
-			if err != nil {
-				return nil, fmt.Errorf("failed to get package info for dependency package %q: %w", suffix, err)
-			}
+	var priorManifest *Manifest
+	if manifestPath := manifestPath(work, opts); manifestPath != "" {
+		priorManifest, err = readManifest(manifestPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read prior manifest: %w", err)
+		}
+	}
+
+	if opts.Provenance {
+		if err := work.addProvenance(priorManifest, opts.Force); err != nil {
+			return nil, err
+		}
+	}
+
+	shared, err := readSharedManifests(dstDir, opts.SharedManifests)
+	if err != nil {
+		return nil, err
+	}
+	if err := work.reuseSharedFiles(shared); err != nil {
+		return nil, err
+	}
 
-			work.addPackageReplacement(depInfo.ImportPath, path.Join(work.DstModule, "internal", suffix))
-			work.addCopies(depSrcDir, depDstDir, depInfo.AllFiles())
+	if opts.Merge {
+		if err := work.prepareMerge(opts.AllowExportRename); err != nil {
+			return nil, err
 		}
+	} else if !opts.Force {
+		// Without a prior manifest there is no telling which destination
+		// files earlier runs wrote, so any existing Go files in the
+		// destination of a dependency are treated as unmanaged.
+		if err := work.checkUnmanagedPackages(priorManifest, shared); err != nil {
+			return nil, err
+		}
+	}
+	if err := work.checkIdentRenames(); err != nil {
+		return nil, err
+	}
+	if err := work.checkPackageDirs(); err != nil {
+		return nil, err
+	}
+	if err := work.checkDstCollisions(); err != nil {
+		return nil, err
+	}
+	if err := work.checkInternalVisibility(); err != nil {
+		return nil, err
 	}
 
 	return work, nil
 }
 
 func copyOtherFile(srcPath, dstPath string) error {
-	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+	if err := ensureDir(filepath.Dir(dstPath)); err != nil {
 		return fmt.Errorf("failed to ensure destination directory exists: %w", err)
 	}
 
@@ -218,7 +1683,7 @@ func copyOtherFile(srcPath, dstPath string) error {
 		_ = src.Close()
 	}()
 
-	dst, err := os.Create(dstPath)
+	dst, err := os.OpenFile(dstPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, fileMode)
 	if err != nil {
 		return fmt.Errorf("failed to create destination file: %w", err)
 	}
@@ -233,44 +1698,194 @@ func copyOtherFile(srcPath, dstPath string) error {
 	if err := dst.Close(); err != nil {
 		return fmt.Errorf("failed to close destination file: %w", err)
 	}
+	if err := os.Chmod(dstPath, fileMode); err != nil {
+		return fmt.Errorf("failed to set destination file mode: %w", err)
+	}
 
 	return nil
 }
 
-func copyGoFile(srcPath, dstPath string, r *strings.Replacer, localModule string) error {
+// goFileCopier copies Go source files into the destination, rewriting source
+// import paths to their destination counterparts.
+type goFileCopier struct {
+	replacer    *strings.Replacer
+	paths       map[string]string
+	localModule string
+
+	flattenDir  string
+	flattenPath string
+	flattened   map[string]string
+
+	// renames maps the source import path of each renamed package to its old
+	// and new names, and renameDirs maps the source directory of each renamed
+	// package to its new name.
+	renames    map[string][2]string
+	renameDirs map[string]string
+
+	// identRenames and qualifiedIdentRenames hold the renames of colliding
+	// identifiers; see renameIdents.
+	identRenames          map[string]map[string]string
+	qualifiedIdentRenames map[string]qualifiedRenames
+
+	formatGenerated   bool
+	noImportPrune     bool
+	preferSourceOrder bool
+	eol               string
+	embedRewrites     map[string]map[string]string
+}
+
+func newGoFileCopier(work *Work, opts *Options) *goFileCopier {
+	c := &goFileCopier{
+		replacer: strings.NewReplacer(work.PackageReplacements...),
+		paths:    work.packagePaths(),
+
+		flattenDir:  work.FlattenDir,
+		flattenPath: work.FlattenPath,
+		flattened:   work.FlattenedPackages,
+
+		renames:    make(map[string][2]string),
+		renameDirs: make(map[string]string),
+
+		formatGenerated:   opts.FormatGenerated,
+		noImportPrune:     opts.NoImportPrune,
+		preferSourceOrder: opts.PreferSourceOrder,
+		eol:               eolLF,
+		embedRewrites:     work.EmbedRewrites,
+	}
+	switch {
+	case opts.LocalPrefix != "":
+		c.localModule = opts.LocalPrefix
+	case opts.LocalImports:
+		c.localModule = work.DstModule
+	}
+	if opts.EOL != "" {
+		c.eol = opts.EOL
+	}
+	c.identRenames, c.qualifiedIdentRenames = work.identRenameSets()
+	for importPath, name := range work.PackageRenames {
+		pkg := work.findPackage(importPath)
+		c.renames[importPath] = [2]string{pkg.Name, name}
+		c.renameDirs[pkg.SrcDir] = name
+	}
+	return c
+}
+
+func (c *goFileCopier) copyGoFile(srcPath, dstPath string) error {
 	data, err := os.ReadFile(srcPath)
 	if err != nil {
 		return errs.Wrap(err)
 	}
 
+	if len(c.identRenames) > 0 {
+		data, err = renameIdents(srcPath, data, c.identRenames[filepath.Dir(srcPath)], c.qualifiedIdentRenames)
+		if err != nil {
+			return fmt.Errorf("failed to rename colliding identifiers in %q: %w", srcPath, err)
+		}
+	}
+
+	if len(c.flattened) > 0 {
+		data, err = flattenImports(srcPath, data, c.flattened, c.flattenPath, filepath.Dir(dstPath) == c.flattenDir)
+		if err != nil {
+			return fmt.Errorf("failed to flatten imports of %q: %w", srcPath, err)
+		}
+	}
+
+	if len(c.renames) > 0 {
+		data, err = renamePackages(srcPath, data, c.renames, c.renameDirs[filepath.Dir(srcPath)])
+		if err != nil {
+			return fmt.Errorf("failed to rename packages in %q: %w", srcPath, err)
+		}
+	}
+
 	code := new(bytes.Buffer)
-	if _, err := r.WriteString(code, string(data)); err != nil {
+	if _, err := c.replacer.WriteString(code, rewriteGenerateDirectives(rewriteLinknames(rewriteEmbedDirectives(string(data), c.embedRewrites[srcPath]), c.paths), c.paths)); err != nil {
 		return errs.Wrap(err)
 	}
+	merged, err := mergeDuplicateImports(dstPath, code.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to merge duplicate imports: %w", err)
+	}
 
-	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+	if err := ensureDir(filepath.Dir(dstPath)); err != nil {
 		return fmt.Errorf("failed to ensure destination directory exists: %w", err)
 	}
 
-	if err := os.WriteFile(dstPath, code.Bytes(), 0644); err != nil {
+	if err := writeFile(dstPath, merged); err != nil {
 		return fmt.Errorf("failed to write destination file: %w", err)
 	}
 
-	args := []string{"goimports", "-w"}
-	if localModule != "" {
-		args = append(args, "-local", localModule)
+	// Generated files may be intentionally formatted in ways goimports would
+	// disturb, so they only get the import path rewriting.
+	if !c.formatGenerated && isGeneratedFile(srcPath, data) {
+		logger.Debug("Skipping formatting of generated file", "src", srcPath, "dst", dstPath)
+		return normalizeFileEOL(dstPath, c.eol)
+	}
+
+	// gofmt only formats, so imports that look unused (e.g. because their
+	// only uses are in files for other platforms) are never removed. With
+	// -prefer-source-order, the imports are not sorted either.
+	if c.noImportPrune || c.preferSourceOrder {
+		formatSource := format.Source
+		if c.preferSourceOrder {
+			formatSource = formatKeepingImportOrder
+		}
+		formatted, err := formatSource(merged)
+		if err != nil {
+			return fmt.Errorf("failed to format %q: %w", dstPath, err)
+		}
+		if err := writeFile(dstPath, formatted); err != nil {
+			return fmt.Errorf("failed to write destination file: %w", err)
+		}
+		return normalizeFileEOL(dstPath, c.eol)
+	}
+
+	args := []string{"-w"}
+	if c.localModule != "" {
+		args = append(args, "-local", c.localModule)
 	}
 	args = append(args, filepath.Base(dstPath))
 
 	if err := execInDir(filepath.Dir(dstPath), "goimports", args...); err != nil {
 		return err
 	}
+	if err := checkPackageClause(dstPath, merged); err != nil {
+		return err
+	}
+
+	return normalizeFileEOL(dstPath, c.eol)
+}
 
+// checkPackageClause ensures formatting the destination file did not change
+// the package name in the rewritten source it was formatted from.
+func checkPackageClause(dstPath string, rewritten []byte) error {
+	before, err := parser.ParseFile(token.NewFileSet(), dstPath, rewritten, parser.PackageClauseOnly)
+	if err != nil {
+		return fmt.Errorf("failed to parse package clause of %q: %w", dstPath, err)
+	}
+	after, err := parser.ParseFile(token.NewFileSet(), dstPath, nil, parser.PackageClauseOnly)
+	if err != nil {
+		return fmt.Errorf("failed to parse package clause of %q after formatting: %w", dstPath, err)
+	}
+	if before.Name.Name != after.Name.Name {
+		return fmt.Errorf("formatting %q unexpectedly changed its package name from %q to %q", dstPath, before.Name.Name, after.Name.Name)
+	}
 	return nil
 }
 
+// isGeneratedFile returns true if the Go source carries the standard
+// "Code generated ... DO NOT EDIT." marker.
+func isGeneratedFile(path string, data []byte) bool {
+	file, err := parser.ParseFile(token.NewFileSet(), path, data, parser.PackageClauseOnly|parser.ParseComments)
+	if err != nil {
+		return false
+	}
+	return ast.IsGenerated(file)
+}
+
 type packageInfo struct {
+	Dir        string
 	ImportPath string
+	Name       string
 	Module     struct {
 		Path  string
 		Dir   string
@@ -292,14 +1907,147 @@ type packageInfo struct {
 	SwigCXXFiles      []string
 	SysoFiles         []string
 	EmbedFiles        []string
+	TestGoFiles       []string
+	XTestGoFiles      []string
+
+	Deps         []string
+	TestImports  []string
+	XTestImports []string
+}
+
+// filesToCopy returns the package files to copy, including test files (among
+// them example tests) if tests is set, and separately the files of the
+// testdata directory, also only if tests is set. Symlinks in testdata are
+// only included if preserveSymlinks is set. Files excluded by build
+// constraints (for the context the package was listed in) are dropped if
+// dropIgnored is set, and ignore-tagged files are dropped if ignoreTagged is
+// ignoreTaggedDrop.
+func (info *packageInfo) filesToCopy(tests, dropIgnored bool, ignoreTagged string, preserveSymlinks bool) (files, testdata []string, err error) {
+	if dropIgnored || ignoreTagged == ignoreTaggedDrop {
+		ignored := make(map[string]bool)
+		if dropIgnored {
+			for _, file := range info.ignoredFiles() {
+				ignored[file] = true
+			}
+		}
+		if ignoreTagged == ignoreTaggedDrop {
+			for _, file := range info.ignoreTaggedFiles() {
+				ignored[file] = true
+			}
+		}
+		for _, file := range info.AllFiles() {
+			if !ignored[file] {
+				files = append(files, file)
+			}
+		}
+	} else {
+		files = info.AllFiles()
+	}
+	if tests {
+		files = append(files, info.TestGoFiles...)
+		files = append(files, info.XTestGoFiles...)
+		testdata, err = info.testdataFiles(preserveSymlinks)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return files, testdata, nil
+}
+
+// testdataFiles returns the files beneath the testdata directory of the
+// package, which go list does not report but tests (and the examples among
+// them) commonly read fixtures from. Symlinks to files are only returned if
+// preserveSymlinks is set, to be recreated as symlinks; their targets are not
+// otherwise copied.
+func (info *packageInfo) testdataFiles(preserveSymlinks bool) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(filepath.Join(info.Dir, "testdata"), func(path string, entry fs.DirEntry, walkErr error) error {
+		switch {
+		case errors.Is(walkErr, fs.ErrNotExist):
+			return nil
+		case walkErr != nil:
+			return walkErr
+		case entry.Type()&fs.ModeSymlink != 0:
+			if !preserveSymlinks {
+				logger.Debug("Skipping symlink in testdata", "path", path)
+				return nil
+			}
+			if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+				return nil
+			}
+		case !entry.Type().IsRegular():
+			return nil
+		}
+		rel, err := filepath.Rel(info.Dir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, rel)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list testdata of %q: %w", info.ImportPath, err)
+	}
+	return files, nil
+}
+
+// isTestdataPath reports whether the path is beneath a testdata directory,
+// which the go tool never treats as part of a package.
+func isTestdataPath(path string) bool {
+	for _, elem := range strings.Split(filepath.ToSlash(path), "/") {
+		if elem == "testdata" {
+			return true
+		}
+	}
+	return false
+}
+
+// imports returns the packages the package depends on, including the direct
+// imports of its tests if tests is set and of its ignore-tagged files if
+// ignoreTagged is set. A package imported both by the
+// package and by its tests is only returned once.
+func (info *packageInfo) imports(tests, ignoreTagged bool) []string {
+	imports := append([]string(nil), info.Deps...)
+	if ignoreTagged {
+		imports = append(imports, info.ignoreTaggedImports()...)
+	}
+	if tests {
+		imports = append(imports, info.TestImports...)
+		imports = append(imports, info.XTestImports...)
+	}
+	slices.Sort(imports)
+	return slices.Compact(imports)
+}
+
+// logDroppedPlatformFiles reports the files of the package that are dropped
+// because they are not buildable for the platform, if one is set.
+func logDroppedPlatformFiles(info *packageInfo, platform string) {
+	if platform == "" {
+		return
+	}
+	for _, file := range info.ignoredFiles() {
+		logger.Info("Dropping file not buildable for platform", "pkg", info.ImportPath, "file", file, "platform", platform)
+	}
+}
 
-	Deps []string
+// ignoredFiles returns the package files excluded by build constraints.
+func (info *packageInfo) ignoredFiles() []string {
+	return append(append([]string(nil), info.IgnoredGoFiles...), info.IgnoredOtherFiles...)
 }
 
 func (info *packageInfo) AllFiles() (all []string) {
 	all = append(all, info.GoFiles...)
 	all = append(all, info.CgoFiles...)
-	all = append(all, info.CompiledGoFiles...)
+	// For cgo packages, CompiledGoFiles includes generated files that live
+	// in the build cache rather than the package directory. Only real source
+	// files are copied.
+	for _, file := range info.CompiledGoFiles {
+		if filepath.IsLocal(file) {
+			all = append(all, file)
+		} else if rel, err := filepath.Rel(info.Dir, file); err == nil && filepath.IsLocal(rel) {
+			all = append(all, rel)
+		}
+	}
 	all = append(all, info.IgnoredGoFiles...)
 	all = append(all, info.IgnoredOtherFiles...)
 	all = append(all, info.CFiles...)
@@ -321,29 +2069,100 @@ func getModulePath(dir string) (string, error) {
 			Path string
 		}
 	}{}
-	if err := execInDirAndParseJSON(dir, info, "go", "mod", "edit", "-json"); err != nil {
+	if err := execInDirAndParseJSON(dir, info, goBin, "mod", "edit", "-json"); err != nil {
 		return "", err
 	}
 	return info.Module.Path, nil
 }
 
-func getPackageInfo(dir string) (*packageInfo, error) {
+// resolveSrcPkg locates the directory of the source package with the given
+// import path as seen from the current directory, e.g. in the module cache
+// or a workspace.
+func resolveSrcPkg(importPath string) (string, error) {
+	info, err := getPackageInfo(".", importPath, nil, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve source package %q (is it required by the current module and downloaded?): %w", importPath, err)
+	}
+	if info.Dir == "" {
+		return "", fmt.Errorf("source package %q was not found", importPath)
+	}
+	logger.Debug("Resolved source package", "pkg", importPath, "src", info.Dir)
+	return info.Dir, nil
+}
+
+// getPackageInfo lists the package matching pattern from dir with go list.
+// The variables in env, if any, are added to the environment of go list.
+func getPackageInfo(dir, pattern string, flags, env []string) (*packageInfo, error) {
 	info := new(packageInfo)
-	if err := execInDirAndParseJSON(dir, info, "go", "list", "-json", "."); err != nil {
+	args := append([]string{"list", "-json"}, flags...)
+	args = append(args, pattern)
+	cmd := exec.Command(goBin, args...)
+	cmd.Dir = dir
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	if err := runAndParseJSON(cmd, info); err != nil {
 		return nil, err
 	}
 	return info, nil
 }
 
-func cleanDst(dir string) error {
+// checkDstWritable ensures the destination directory, and every directory
+// beneath it holding Go files that cleaning may remove, is writable. It runs
+// before anything is removed so that a permission problem cannot leave the
+// destination half cleaned.
+func checkDstWritable(dir string) error {
+	checked := make(map[string]bool)
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return fmt.Errorf("destination is not accessible: %w", walkErr)
+		}
+		if isDotEntry(dir, path) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		checkDir := filepath.Dir(path)
+		switch {
+		case entry.IsDir() && filepath.Clean(path) == filepath.Clean(dir):
+			checkDir = path
+		case entry.IsDir() || filepath.Ext(path) != ".go":
+			return nil
+		}
+		if checked[checkDir] {
+			return nil
+		}
+		checked[checkDir] = true
+
+		f, err := os.CreateTemp(checkDir, ".mirage-write-check-*")
+		if err != nil {
+			return fmt.Errorf("destination directory %q is not writable; fix its permissions before running again: %w", checkDir, err)
+		}
+		_ = f.Close()
+		if err := os.Remove(f.Name()); err != nil {
+			return fmt.Errorf("destination directory %q does not allow removing files; fix its permissions before running again: %w", checkDir, err)
+		}
+		return nil
+	})
+}
+
+// cleanDst removes the Go files beneath dir, except for those in keep (e.g.
+// the files managed by other transplants sharing the destination), and
+// returns the removed files. With keepEmptyDirs, the directories files were
+// removed from are also returned rather than pruned.
+func cleanDst(dir string, keep map[string]ManifestFile, keepEmptyDirs bool) ([]string, []string, error) {
 	// Remove go src files, skipping any directory with a leading dot
+	var removed []string
+	emptied := make(map[string]bool)
 	if err := filepath.Walk(dir, filepath.WalkFunc(func(path string, info fs.FileInfo, walkErr error) error {
 		if walkErr != nil {
 			return errs.Wrap(walkErr)
 		}
 
 		// Skip files and folders beginning with dot
-		if strings.HasPrefix(path, ".") {
+		if isDotEntry(dir, path) {
 			if info.IsDir() {
 				return filepath.SkipDir
 			}
@@ -355,61 +2174,179 @@ func cleanDst(dir string) error {
 			return nil
 		}
 
+		// Never touch the destination module files
+		if isDstModuleFile(dir, path) {
+			return nil
+		}
+
 		// Skip non-go files
 		if filepath.Ext(path) != ".go" {
 			return nil
 		}
+		if _, ok := keep[filepath.Clean(path)]; ok {
+			return nil
+		}
+		emptied[filepath.Dir(path)] = true
+		removed = append(removed, path)
 		return errs.Wrap(os.Remove(path))
 	})); err != nil {
-		return errs.Wrap(err)
+		return nil, nil, errs.Wrap(err)
 	}
 
-	// Now remove empty directories
-	if err := filepath.Walk(dir, filepath.WalkFunc(func(path string, info fs.FileInfo, walkErr error) error {
-		switch {
-		case walkErr != nil:
-			return errs.Wrap(walkErr)
-		case !info.IsDir():
-			return nil
-		}
+	// With -keep-empty-dirs the emptied directories are left for
+	// keepEmptyDirs to hold open if nothing is copied into them.
+	dirs := sortedKeys(emptied)
+	if keepEmptyDirs {
+		return removed, dirs, nil
+	}
 
-		if children, err := os.ReadDir(path); err != nil {
-			return errs.Wrap(err)
-		} else if len(children) > 0 {
-			return nil
+	// Now remove the directories left empty by removing their files, along
+	// with any parents left empty in turn, never pruning the destination root
+	// (which holds go.mod and go.sum). Directories that were already empty
+	// (e.g. placeholders created by hand) are left alone.
+	sort.Slice(dirs, func(i, j int) bool {
+		return len(dirs[i]) > len(dirs[j])
+	})
+	for _, path := range dirs {
+		for ; filepath.Clean(path) != filepath.Clean(dir); path = filepath.Dir(path) {
+			if children, err := os.ReadDir(path); err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					break
+				}
+				return nil, nil, errs.Wrap(err)
+			} else if len(children) > 0 {
+				break
+			}
+			if err := os.Remove(path); err != nil {
+				return nil, nil, errs.Wrap(err)
+			}
 		}
-		return errs.Wrap(os.Remove(path))
-	})); err != nil {
-		return errs.Wrap(err)
 	}
 
-	return nil
+	return removed, nil, nil
+}
+
+// isDotEntry returns true if path, found while walking root, names a file or
+// directory beginning with a dot. The root itself is never considered one,
+// so "." and ".." can be used as a destination.
+func isDotEntry(root, path string) bool {
+	if filepath.Clean(path) == filepath.Clean(root) {
+		return false
+	}
+	return strings.HasPrefix(filepath.Base(path), ".")
+}
+
+// isDstModuleFile returns true if path is the go.mod or go.sum at the root of
+// the destination.
+func isDstModuleFile(root, path string) bool {
+	if filepath.Clean(filepath.Dir(path)) != filepath.Clean(root) {
+		return false
+	}
+	switch filepath.Base(path) {
+	case "go.mod", "go.sum":
+		return true
+	}
+	return false
 }
 
 func execInDir(dir string, name string, args ...string) error {
+	output, err := execInDirCombinedOutput(dir, name, args...)
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, output)
+	}
+	return nil
+}
+
+func execInDirCombinedOutput(dir string, name string, args ...string) (string, error) {
 	cmd := exec.Command(name, args...)
 	cmd.Dir = dir
+	return runCombinedOutput(cmd)
+}
+
+func runCombinedOutput(cmd *exec.Cmd) (string, error) {
+	start := time.Now()
 	output, err := cmd.CombinedOutput()
+	observeExec(cmd, start, err)
+	return string(output), err
+}
+
+func execInDirOutput(dir string, name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	output, err := runOutput(cmd)
+	return string(output), err
+}
+
+func runOutput(cmd *exec.Cmd) ([]byte, error) {
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	start := time.Now()
+	output, err := cmd.Output()
+	observeExec(cmd, start, err)
 	if err != nil {
-		return fmt.Errorf("%w: %s", err, string(output))
+		return nil, fmt.Errorf("%w: %s", err, stderr.String())
 	}
-	return nil
+	return output, nil
 }
 
 func execInDirAndParseJSON(dir string, obj interface{}, name string, args ...string) error {
-	stdout := new(bytes.Buffer)
-	stderr := new(bytes.Buffer)
 	cmd := exec.Command(name, args...)
 	cmd.Dir = dir
-	cmd.Stdout = stdout
+	return runAndParseJSON(cmd, obj)
+}
+
+func runAndParseJSON(cmd *exec.Cmd, obj interface{}) error {
+	return runAndDecodeJSON(cmd, func(decoder *json.Decoder) error {
+		if err := decoder.Decode(obj); err != nil {
+			return fmt.Errorf("failed to unmarshal package info: %w", err)
+		}
+		if decoder.More() {
+			return errors.New("failed to unmarshal package info: unexpected data after JSON object")
+		}
+		return nil
+	})
+}
+
+// runAndDecodeJSON runs the command, passing decode a decoder reading its
+// stdout as it is written, so that large output (such as the concatenated
+// objects printed by go list -json for many packages) is never held in a
+// single buffer. Any output decode leaves unread is discarded so the command
+// can finish.
+func runAndDecodeJSON(cmd *exec.Cmd, decode func(*json.Decoder) error) error {
+	stderr := new(bytes.Buffer)
 	cmd.Stderr = stderr
-	if err := cmd.Run(); err != nil {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		observeExec(cmd, start, err)
+		return err
+	}
+	decodeErr := decode(json.NewDecoder(stdout))
+	_, _ = io.Copy(io.Discard, stdout)
+	err = cmd.Wait()
+	observeExec(cmd, start, err)
+	if err != nil {
 		return fmt.Errorf("%w: %s", err, stderr.String())
 	}
-	if err := json.Unmarshal(stdout.Bytes(), obj); err != nil {
-		return fmt.Errorf("failed to unmarshal package info: %w", err)
+	return decodeErr
+}
+
+// observeExec reports a finished command to the exec observer, if any.
+func observeExec(cmd *exec.Cmd, start time.Time, err error) {
+	if execObserver != nil {
+		execObserver(cmd.Args, cmd.Dir, time.Since(start), err)
 	}
-	return nil
+}
+
+// inModule reports whether the go command finds a go.mod for dir, i.e.
+// whether go env GOMOD names one.
+func inModule(dir string) bool {
+	output, err := execInDirOutput(dir, goBin, "env", "GOMOD")
+	goMod := strings.TrimSpace(output)
+	return err == nil && goMod != "" && goMod != os.DevNull
 }
 
 func fileExists(path string) bool {
@@ -0,0 +1,830 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	// Transplants must not reach the network or switch toolchains.
+	os.Setenv("GOPROXY", "off")
+	os.Setenv("GOTOOLCHAIN", "local")
+	os.Setenv("GOWORK", "off")
+	os.Setenv("GOFLAGS", "")
+	os.Exit(m.Run())
+}
+
+func TestCleanDstKeepsModuleFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"go.mod":        "module example.com/new\n",
+		"go.sum":        "example.com/dep v1.0.0 h1:abc=\n",
+		"dst.go":        "package dst\n",
+		"sub/sub.go":    "package sub\n",
+		"nested/go.mod": "module example.com/nested\n",
+	})
+
+	if _, _, err := cleanDst(dir, nil, false); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rel := range []string{"go.mod", "go.sum", "nested/go.mod"} {
+		if !fileExists(filepath.Join(dir, rel)) {
+			t.Errorf("expected %s to be kept", rel)
+		}
+	}
+	for _, rel := range []string{"dst.go", "sub"} {
+		if _, err := os.Stat(filepath.Join(dir, rel)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed (err=%v)", rel, err)
+		}
+	}
+}
+
+func TestCleanDstKeepsRootWithOnlyModuleFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"go.mod": "module example.com/new\n",
+		"go.sum": "",
+		"dst.go": "package dst\n",
+	})
+
+	if _, _, err := cleanDst(dir, nil, false); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rel := range []string{"go.mod", "go.sum"} {
+		if !fileExists(filepath.Join(dir, rel)) {
+			t.Errorf("expected %s to be kept", rel)
+		}
+	}
+}
+
+func TestCleanDstKeepsEmptyUserDirectories(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"go.mod":       "module example.com/new\n",
+		"a/b/b.go":     "package b\n",
+		"a/keep/.keep": "",
+		"c/c.go":       "package c\n",
+	})
+	for _, rel := range []string{"migrations", "c/placeholder"} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.FromSlash(rel)), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err := cleanDst(dir, nil, false); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rel := range []string{"migrations", "a/keep", "c/placeholder"} {
+		if info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(rel))); err != nil || !info.IsDir() {
+			t.Errorf("expected %s to be kept (err=%v)", rel, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a", "b")); !os.IsNotExist(err) {
+		t.Errorf("expected a/b to be removed once emptied (err=%v)", err)
+	}
+}
+
+func TestSameModuleSkipsIdentityReplacement(t *testing.T) {
+	srcDir := newModule(t, "example.com/old", map[string]string{
+		"foo.go":       "package foo\n\nimport \"example.com/old/util\"\n\nvar _ = util.Util\n",
+		"util/util.go": "package util\n\nfunc Util() {}\n",
+	})
+	dstDir := newModule(t, "example.com/old", nil)
+
+	work, err := transplantForTest(t, dstDir, srcDir, testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(work.PackageReplacements); i += 2 {
+		if work.PackageReplacements[i] == work.PackageReplacements[i+1] {
+			t.Errorf("unexpected identity replacement of %s", work.PackageReplacements[i])
+		}
+	}
+	if got := readFile(t, filepath.Join(dstDir, "go.mod")); !strings.HasPrefix(got, "module example.com/old\n") {
+		t.Errorf("unexpected destination go.mod:\n%s", got)
+	}
+	if got := readFile(t, filepath.Join(dstDir, "foo.go")); !strings.Contains(got, strconv.Quote("example.com/old/internal/util")) {
+		t.Errorf("expected the dependency to be relocated beneath internal/:\n%s", got)
+	}
+	buildModule(t, dstDir)
+}
+
+func TestTransplantFromModuleCache(t *testing.T) {
+	if _, err := exec.LookPath(goBin); err != nil {
+		t.Skipf("go command not found: %v", err)
+	}
+	modCache := t.TempDir()
+	t.Setenv("GOMODCACHE", modCache)
+	modDir := filepath.Join(modCache, "example.com", "old@v1.2.3")
+	writeFiles(t, modDir, map[string]string{
+		"go.mod":       "module example.com/old\n\ngo 1.21\n",
+		"foo/foo.go":   "package foo\n\nimport \"example.com/old/util\"\n\nvar _ = util.Util\n",
+		"util/util.go": "package util\n\nfunc Util() {}\n",
+	})
+	makeReadOnly(t, modDir)
+	dstDir := newModule(t, "example.com/new", nil)
+
+	if _, err := transplantForTest(t, dstDir, filepath.Join(modDir, "foo"), testOptions()); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(dstDir, "foo.go")); !strings.Contains(got, strconv.Quote("example.com/new/internal/util")) {
+		t.Errorf("expected the dependency to be relocated beneath internal/:\n%s", got)
+	}
+	if fileExists(filepath.Join(modDir, "go.sum")) {
+		t.Error("expected the module cache to be left untouched")
+	}
+	buildModule(t, dstDir)
+}
+
+func TestAllFilesSkipsCompiledFilesOutsidePackage(t *testing.T) {
+	dir := t.TempDir()
+	info := &packageInfo{
+		Dir:      dir,
+		GoFiles:  []string{"foo.go"},
+		CgoFiles: []string{"cgo.go"},
+		CompiledGoFiles: []string{
+			"foo.go",
+			filepath.Join(dir, "bar.go"),
+			filepath.Join(t.TempDir(), "go-build", "_cgo_gotypes.go"),
+		},
+	}
+	got := make(map[string]bool)
+	for _, file := range info.AllFiles() {
+		got[file] = true
+	}
+	for _, want := range []string{"foo.go", "cgo.go", "bar.go"} {
+		if !got[want] {
+			t.Errorf("expected %s to be copied", want)
+		}
+	}
+	for file := range got {
+		if !filepath.IsLocal(file) {
+			t.Errorf("unexpected file outside the package directory: %s", file)
+		}
+	}
+}
+
+func TestTransplantCgoPackageCopiesOnlySource(t *testing.T) {
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skipf("cgo needs a C compiler: %v", err)
+	}
+	t.Setenv("CGO_ENABLED", "1")
+	srcDir := newModule(t, "example.com/old", map[string]string{
+		"cgo.go": "package foo\n\n// int answer(void) { return 42; }\nimport \"C\"\n\nfunc Answer() int { return int(C.answer()) }\n",
+		"foo.go": "package foo\n\nfunc Foo() int { return Answer() }\n",
+	})
+	dstDir := newModule(t, "example.com/new", nil)
+
+	if _, err := transplantForTest(t, dstDir, srcDir, testOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dstDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if got, want := strings.Join(names, " "), "cgo.go foo.go go.mod"; got != want {
+		t.Errorf("got destination files %q, want %q", got, want)
+	}
+}
+
+func TestTransplantTestOnlyDependency(t *testing.T) {
+	srcDir := newModule(t, "example.com/old", map[string]string{
+		"foo.go":               "package foo\n\nfunc Foo() int { return 1 }\n",
+		"foo_test.go":          "package foo_test\n\nimport (\n\t\"testing\"\n\n\t\"example.com/old\"\n\t\"example.com/old/testutil\"\n)\n\nfunc TestFoo(t *testing.T) { testutil.Equal(t, foo.Foo(), 1) }\n",
+		"testutil/testutil.go": "package testutil\n\nimport \"testing\"\n\nfunc Equal(t *testing.T, got, want int) {\n\tif got != want {\n\t\tt.Fatal(got, want)\n\t}\n}\n",
+	})
+
+	t.Run("with tests", func(t *testing.T) {
+		dstDir := newModule(t, "example.com/new", nil)
+		opts := testOptions()
+		opts.Tests = true
+		work, err := transplantForTest(t, dstDir, srcDir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkg := work.findPackage("example.com/old/testutil"); pkg == nil || pkg.DstImportPath != "example.com/new/internal/testutil" {
+			t.Errorf("expected the test-only dependency to be transplanted beneath internal/, got %+v", pkg)
+		}
+		if got := readFile(t, filepath.Join(dstDir, "foo_test.go")); !strings.Contains(got, strconv.Quote("example.com/new/internal/testutil")) {
+			t.Errorf("expected the test import to be rewritten:\n%s", got)
+		}
+		if output, err := execInDirCombinedOutput(dstDir, goBin, "vet", "./..."); err != nil {
+			t.Fatalf("destination tests do not build: %v\n%s", err, output)
+		}
+	})
+
+	t.Run("without tests", func(t *testing.T) {
+		dstDir := newModule(t, "example.com/new", nil)
+		if _, err := transplantForTest(t, dstDir, srcDir, testOptions()); err != nil {
+			t.Fatal(err)
+		}
+		for _, rel := range []string{"foo_test.go", "internal/testutil"} {
+			if _, err := os.Stat(filepath.Join(dstDir, filepath.FromSlash(rel))); !os.IsNotExist(err) {
+				t.Errorf("expected %s not to be copied (err=%v)", rel, err)
+			}
+		}
+	})
+}
+
+func TestTransplantDependencyImportedByCodeAndTests(t *testing.T) {
+	srcDir := newModule(t, "example.com/old", map[string]string{
+		"foo.go":            "package foo\n\nimport \"example.com/old/util\"\n\nvar Foo = util.U\n",
+		"foo_test.go":       "package foo\n\nimport (\n\t\"testing\"\n\n\t\"example.com/old/util\"\n)\n\nfunc TestFoo(t *testing.T) { _ = util.U }\n",
+		"util/util.go":      "package util\n\nvar U = 1\n",
+		"util/util_test.go": "package util\n\nimport \"testing\"\n\nfunc TestU(t *testing.T) {}\n",
+	})
+	dstDir := newModule(t, "example.com/new", nil)
+
+	opts := testOptions()
+	opts.Tests = true
+	work, err := transplantForTest(t, dstDir, srcDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, pkg := range work.Packages {
+		if pkg.SrcImportPath == "example.com/old/util" {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("expected the dependency to be transplanted once, got %d times", count)
+	}
+	for _, rel := range []string{"internal/util/util.go", "internal/util/util_test.go"} {
+		if !fileExists(filepath.Join(dstDir, filepath.FromSlash(rel))) {
+			t.Errorf("expected %s to be copied", rel)
+		}
+	}
+	if output, err := execInDirCombinedOutput(dstDir, goBin, "vet", "./..."); err != nil {
+		t.Fatalf("destination tests do not build: %v\n%s", err, output)
+	}
+
+	info := &packageInfo{Deps: []string{"example.com/old/util", "testing"}, TestImports: []string{"example.com/old/util", "testing"}}
+	if got := info.imports(true, false); len(got) != 2 {
+		t.Errorf("expected each import once, got %v", got)
+	}
+}
+
+func TestTransplantInternalDependencies(t *testing.T) {
+	srcDir := newModule(t, "example.com/old", map[string]string{
+		"b/b.go":                    "package b\n\nimport (\n\t\"example.com/old/b/internal/c\"\n\t\"example.com/old/internal\"\n\t\"example.com/old/internal/a\"\n)\n\nvar _, _, _ = a.A, c.C, internal.I\n",
+		"b/internal/c/c.go":         "package c\n\nimport \"example.com/old/internal/a\"\n\nvar C = a.A\n",
+		"internal/a/a.go":           "package a\n\nvar A = 1\n",
+		"internal/internal.go":      "package internal\n\nvar I = 1\n",
+		"internal/unused/unused.go": "package unused\n",
+	})
+	dstDir := newModule(t, "example.com/new", nil)
+
+	work, err := transplantForTest(t, dstDir, filepath.Join(srcDir, "b"), testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"example.com/old/b":            "example.com/new",
+		"example.com/old/internal/a":   "example.com/new/internal/a",
+		"example.com/old/b/internal/c": "example.com/new/internal/b/c",
+		"example.com/old/internal":     "example.com/new/internal",
+	}
+	for src, dst := range want {
+		if pkg := work.findPackage(src); pkg == nil || pkg.DstImportPath != dst {
+			t.Errorf("expected %s to be transplanted to %s, got %+v", src, dst, pkg)
+		}
+	}
+	if len(work.Packages) != len(want) {
+		t.Errorf("got %d packages, want %d", len(work.Packages), len(want))
+	}
+	buildModule(t, dstDir)
+}
+
+func TestTransplantIntoInternalDstModule(t *testing.T) {
+	srcDir := newModule(t, "example.com/old", map[string]string{
+		"b/b.go":          "package b\n\nimport \"example.com/old/internal/a\"\n\nvar B = a.A\n",
+		"internal/a/a.go": "package a\n\nvar A = 1\n",
+	})
+	dstDir := newModule(t, "example.com/x/internal", nil)
+
+	work, err := transplantForTest(t, dstDir, filepath.Join(srcDir, "b"), testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg := work.findPackage("example.com/old/internal/a"); pkg == nil || pkg.DstImportPath != "example.com/x/internal/internal/a" {
+		t.Errorf("expected the dependency to be placed beneath the destination module, got %+v", pkg)
+	}
+	buildModule(t, dstDir)
+}
+
+func TestTransplantRejectsDstImportPathCollisions(t *testing.T) {
+	srcDir := newModule(t, "example.com/old", map[string]string{
+		"b/b.go":          "package b\n\nimport (\n\t\"example.com/old/internal/a\"\n\t\"example.com/old/internal/c\"\n)\n\nvar B = a.A + c.C\n",
+		"internal/a/a.go": "package a\n\nvar A = 1\n",
+		"internal/c/c.go": "package c\n\nvar C = 1\n",
+	})
+
+	for name, mappings := range map[string]string{
+		"onto an internal dependency": "example.com/old/internal/a=example.com/new/internal/c",
+		"onto a mapped dependency":    "example.com/old/internal/a=example.com/new/x,example.com/old/internal/c=example.com/new/x",
+	} {
+		t.Run(name, func(t *testing.T) {
+			dstDir := newModule(t, "example.com/new", nil)
+			opts := testOptions()
+			opts.Mappings = strings.Split(mappings, ",")
+			_, err := transplantForTest(t, dstDir, filepath.Join(srcDir, "b"), opts)
+			if err == nil || !strings.Contains(err.Error(), "multiple packages map to the same destination import path") {
+				t.Fatalf("expected a destination import path collision, got %v", err)
+			}
+			if !strings.Contains(err.Error(), "example.com/old/internal/a") {
+				t.Errorf("expected the error to name the colliding source package: %v", err)
+			}
+		})
+	}
+}
+
+func TestApplyEnvDefaultsSkipsExemptFlags(t *testing.T) {
+	flags := flag.NewFlagSet("mirage", flag.ContinueOnError)
+	dstModule := flags.String("dst-module", "", "")
+	goVersion := flags.String("go", "", "")
+	undo := flags.String("undo", "", "")
+	if err := flags.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MIRAGE_DST_MODULE", "example.com/new")
+	t.Setenv("MIRAGE_GO", "/usr/local/go/bin/go")
+	t.Setenv("MIRAGE_UNDO", ".mirage-manifest.json")
+
+	if err := applyEnvDefaults(flags); err != nil {
+		t.Fatal(err)
+	}
+	if *dstModule != "example.com/new" {
+		t.Errorf("expected -dst-module from the environment, got %q", *dstModule)
+	}
+	if *goVersion != "" {
+		t.Errorf("expected MIRAGE_GO not to set -go, got %q", *goVersion)
+	}
+	if *undo != "" {
+		t.Errorf("expected MIRAGE_UNDO not to set -undo, got %q", *undo)
+	}
+}
+
+func TestTransplantCopiesTestdataVerbatim(t *testing.T) {
+	fixtures := map[string]string{
+		"testdata/broken.go":  "package broken\n\nfunc {\n",
+		"testdata/imports.go": "package fixture\n\nimport   \"example.com/old\"\n",
+		"testdata/crlf.txt":   "one\r\ntwo\r\n",
+		"testdata/nested/a.s": "TEXT example.com/old·Foo(SB),0,$0\n",
+	}
+	files := map[string]string{
+		"foo.go":      "package foo\n\nfunc Foo() int { return 1 }\n",
+		"foo_test.go": "package foo\n\nimport \"testing\"\n\nfunc TestFoo(t *testing.T) {}\n",
+	}
+	for name, content := range fixtures {
+		files[name] = content
+	}
+	srcDir := newModule(t, "example.com/old", files)
+	dstDir := newModule(t, "example.com/new", nil)
+
+	opts := testOptions()
+	opts.Tests = true
+	opts.RewriteAsm = true
+	opts.EOL = "lf"
+	work, err := transplantForTest(t, dstDir, srcDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range fixtures {
+		src := filepath.Join(srcDir, filepath.FromSlash(name))
+		if _, ok := work.GoFiles[src]; ok {
+			t.Errorf("expected %s to be copied as a non-Go file", name)
+		}
+		if got := readFile(t, filepath.Join(dstDir, filepath.FromSlash(name))); got != want {
+			t.Errorf("expected %s to be copied verbatim; got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestTransplantModuleRootWithSubpackages(t *testing.T) {
+	srcDir := newModule(t, "example.com/old", map[string]string{
+		"foo.go":   "package foo\n\nimport (\n\t\"example.com/old/a\"\n\t\"example.com/old/b/c\"\n)\n\nvar Foo = a.A + c.C\n",
+		"a/a.go":   "package a\n\nimport \"example.com/old/b/c\"\n\nvar A = c.C\n",
+		"b/c/c.go": "package c\n\nvar C = 1\n",
+	})
+	dstDir := newModule(t, "example.com/new", nil)
+
+	work, err := transplantForTest(t, dstDir, srcDir, testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"example.com/old":     "example.com/new",
+		"example.com/old/a":   "example.com/new/internal/a",
+		"example.com/old/b/c": "example.com/new/internal/b/c",
+	}
+	for src, dst := range want {
+		if pkg := work.findPackage(src); pkg == nil || pkg.DstImportPath != dst {
+			t.Errorf("expected %s to be transplanted to %s, got %+v", src, dst, pkg)
+		}
+	}
+	got := readFile(t, filepath.Join(dstDir, "foo.go"))
+	for _, path := range []string{"example.com/new/internal/a", "example.com/new/internal/b/c"} {
+		if !strings.Contains(got, strconv.Quote(path)) {
+			t.Errorf("expected the root package to import %s:\n%s", path, got)
+		}
+	}
+	buildModule(t, dstDir)
+}
+
+func TestTransplantAllPackagesLeavesModuleFilesToGoModHandling(t *testing.T) {
+	srcDir := newModule(t, "example.com/old", map[string]string{
+		"go.sum":   "example.com/unrelated v1.0.0 h1:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=\n",
+		"foo.go":   "package foo\n\nimport \"example.com/old/sub\"\n\nvar Foo = sub.Sub\n",
+		"sub/s.go": "package sub\n\nvar Sub = 1\n",
+	})
+	dstDir := newModule(t, "example.com/new", nil)
+
+	opts := testOptions()
+	opts.AllPackages = true
+	work, err := transplantForTest(t, dstDir, srcDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for src, dst := range work.OtherFiles {
+		if isDstModuleFile(dstDir, dst) {
+			t.Errorf("expected %s not to be copied onto %s", src, dst)
+		}
+	}
+	if got := readFile(t, filepath.Join(dstDir, "go.mod")); !strings.Contains(got, "module example.com/new\n") {
+		t.Errorf("expected the destination go.mod to keep its module path:\n%s", got)
+	}
+	if _, err := os.Stat(filepath.Join(dstDir, "go.sum")); !os.IsNotExist(err) {
+		t.Errorf("expected the source go.sum not to be copied (err=%v)", err)
+	}
+	buildModule(t, dstDir)
+
+	t.Run("extra file", func(t *testing.T) {
+		opts := testOptions()
+		opts.ExtraFiles = []string{"go.sum"}
+		_, err := transplantForTest(t, newModule(t, "example.com/new", nil), srcDir, opts)
+		if err == nil || !strings.Contains(err.Error(), "managed separately") {
+			t.Fatalf("expected an extra file onto go.sum to be rejected, got %v", err)
+		}
+	})
+}
+
+func TestTransplantTestdataSymlinks(t *testing.T) {
+	srcDir := newModule(t, "example.com/old", map[string]string{
+		"foo.go":            "package foo\n\nfunc Foo() int { return 1 }\n",
+		"foo_test.go":       "package foo\n\nimport \"testing\"\n\nfunc TestFoo(t *testing.T) {}\n",
+		"testdata/real.txt": "real\n",
+	})
+	if err := os.Symlink("real.txt", filepath.Join(srcDir, "testdata", "link.txt")); err != nil {
+		t.Skipf("symlinks are not supported: %v", err)
+	}
+
+	t.Run("skipped by default", func(t *testing.T) {
+		dstDir := newModule(t, "example.com/new", nil)
+		opts := testOptions()
+		opts.Tests = true
+		if _, err := transplantForTest(t, dstDir, srcDir, opts); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Lstat(filepath.Join(dstDir, "testdata", "link.txt")); !os.IsNotExist(err) {
+			t.Errorf("expected the symlink not to be copied (err=%v)", err)
+		}
+		if got := readFile(t, filepath.Join(dstDir, "testdata", "real.txt")); got != "real\n" {
+			t.Errorf("expected the regular file to be copied, got %q", got)
+		}
+	})
+
+	t.Run("preserved", func(t *testing.T) {
+		dstDir := newModule(t, "example.com/new", nil)
+		opts := testOptions()
+		opts.Tests = true
+		opts.PreserveSymlinks = true
+		if _, err := transplantForTest(t, dstDir, srcDir, opts); err != nil {
+			t.Fatal(err)
+		}
+		target, err := os.Readlink(filepath.Join(dstDir, "testdata", "link.txt"))
+		if err != nil {
+			t.Fatalf("expected the symlink to be recreated: %v", err)
+		}
+		if target != "real.txt" {
+			t.Errorf("got symlink target %q, want %q", target, "real.txt")
+		}
+	})
+}
+
+func TestTransplantRejectsSourceOutsideModule(t *testing.T) {
+	srcDir := t.TempDir()
+	writeFiles(t, srcDir, map[string]string{
+		"foo.go": "package foo\n",
+	})
+	dstDir := newModule(t, "example.com/new", nil)
+
+	_, err := transplantForTest(t, dstDir, srcDir, testOptions())
+	if err == nil || !strings.Contains(err.Error(), "is not part of a Go module") {
+		t.Fatalf("expected the source to be rejected as outside a module, got %v", err)
+	}
+
+	t.Run("list error in module", func(t *testing.T) {
+		srcDir := newModule(t, "example.com/old", map[string]string{
+			"foo.go": "package foo\n\nimport \"example.com/missing\"\n",
+		})
+		_, err := transplantForTest(t, newModule(t, "example.com/new", nil), srcDir, testOptions())
+		if err == nil || strings.Contains(err.Error(), "is not part of a Go module") {
+			t.Fatalf("expected the go list error to be reported as is, got %v", err)
+		}
+	})
+}
+
+func TestTransplantKeepsToolchainDirectives(t *testing.T) {
+	mainGo := "//go:debug panicnil=1\n\n// Command foo does nothing.\npackage main\n\nfunc main() {}\n"
+	srcDir := newModule(t, "example.com/old", map[string]string{
+		"main.go": mainGo,
+	})
+	writeFiles(t, srcDir, map[string]string{
+		"go.mod": "module example.com/old\n\ngo 1.21\n\ngodebug (\n\tdefault=go1.21\n\tpanicnil=1\n)\n",
+	})
+	dstDir := newModule(t, "example.com/new", nil)
+
+	if _, err := transplantForTest(t, dstDir, srcDir, testOptions()); err != nil {
+		t.Fatal(err)
+	}
+	goMod := readFile(t, filepath.Join(dstDir, "go.mod"))
+	for _, want := range []string{"module example.com/new\n", "default=go1.21", "panicnil=1"} {
+		if !strings.Contains(goMod, want) {
+			t.Errorf("expected the destination go.mod to contain %q:\n%s", want, goMod)
+		}
+	}
+	if got := readFile(t, filepath.Join(dstDir, "main.go")); got != mainGo {
+		t.Errorf("expected the //go:debug directive to be kept:\n%s", got)
+	}
+	buildModule(t, dstDir)
+}
+
+func TestTransplantIgnoreTaggedGenerator(t *testing.T) {
+	srcDir := newModule(t, "example.com/old", map[string]string{
+		"foo.go":                   "package foo\n\n//go:generate go run gen.go\n\nvar Foo = 1\n",
+		"gen.go":                   "//go:build ignore\n\npackage main\n\nimport \"example.com/old/internal/genutil\"\n\nfunc main() { genutil.Generate() }\n",
+		"internal/genutil/util.go": "package genutil\n\nfunc Generate() {}\n",
+	})
+
+	t.Run("copy", func(t *testing.T) {
+		dstDir := newModule(t, "example.com/new", nil)
+		work, err := transplantForTest(t, dstDir, srcDir, testOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fileExists(filepath.Join(dstDir, "gen.go")) {
+			t.Errorf("expected the generator to be copied")
+		}
+		if pkg := work.findPackage("example.com/old/internal/genutil"); pkg != nil {
+			t.Errorf("expected the generator's dependency not to be transplanted, got %+v", pkg)
+		}
+	})
+
+	t.Run("deps", func(t *testing.T) {
+		dstDir := newModule(t, "example.com/new", nil)
+		opts := testOptions()
+		opts.IgnoreTagged = ignoreTaggedDeps
+		work, err := transplantForTest(t, dstDir, srcDir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkg := work.findPackage("example.com/old/internal/genutil"); pkg == nil || pkg.DstImportPath != "example.com/new/internal/genutil" {
+			t.Errorf("expected the generator's dependency to be transplanted, got %+v", pkg)
+		}
+		if got := readFile(t, filepath.Join(dstDir, "gen.go")); !strings.Contains(got, strconv.Quote("example.com/new/internal/genutil")) {
+			t.Errorf("expected the generator's import to be rewritten:\n%s", got)
+		}
+		if output, err := execInDirCombinedOutput(dstDir, goBin, "run", "gen.go"); err != nil {
+			t.Fatalf("generator does not run: %v\n%s", err, output)
+		}
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		dstDir := newModule(t, "example.com/new", nil)
+		opts := testOptions()
+		opts.IgnoreTagged = ignoreTaggedDrop
+		if _, err := transplantForTest(t, dstDir, srcDir, opts); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(dstDir, "gen.go")); !os.IsNotExist(err) {
+			t.Errorf("expected the generator not to be copied (err=%v)", err)
+		}
+	})
+}
+
+func TestTransplantLeavesMajorVersionSiblingAlone(t *testing.T) {
+	v2Dir := newModule(t, "example.com/old/v2", map[string]string{
+		"x/x.go": "package x\n\nvar X = 2\n",
+	})
+	srcDir := newModule(t, "example.com/old", map[string]string{
+		"foo.go":          "package foo\n\nimport (\n\t\"example.com/old/internal/a\"\n\t\"example.com/old/v2/x\"\n)\n\nvar Foo = a.A + x.X\n",
+		"internal/a/a.go": "package a\n\nvar A = 1\n",
+	})
+	writeFiles(t, srcDir, map[string]string{
+		"go.mod": "module example.com/old\n\ngo 1.21\n\nrequire example.com/old/v2 v2.0.0\n\nreplace example.com/old/v2 => " + v2Dir + "\n",
+	})
+	dstDir := newModule(t, "example.com/new", nil)
+
+	work, err := transplantForTest(t, dstDir, srcDir, testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg := work.findPackage("example.com/old/v2/x"); pkg != nil {
+		t.Errorf("expected the major version sibling to stay an external dependency, got %+v", pkg)
+	}
+	got := readFile(t, filepath.Join(dstDir, "foo.go"))
+	for _, path := range []string{"example.com/new/internal/a", "example.com/old/v2/x"} {
+		if !strings.Contains(got, strconv.Quote(path)) {
+			t.Errorf("expected foo.go to import %s:\n%s", path, got)
+		}
+	}
+	if goMod := readFile(t, filepath.Join(dstDir, "go.mod")); !strings.Contains(goMod, "example.com/old/v2 v2.0.0") {
+		t.Errorf("expected the destination to keep requiring the sibling module:\n%s", goMod)
+	}
+	buildModule(t, dstDir)
+}
+
+func TestStrictReportsUnparsedSourcesBeforeWriting(t *testing.T) {
+	srcDir := newModule(t, "example.com/old", map[string]string{
+		"foo.go":  "package foo\n\nfunc Foo() int { return 1 }\n",
+		"gen.go":  "//go:build ignore\n\npackage main\n\nfunc {\n",
+		"tool.go": "//go:build ignore\n\npackage main\n\nvar = 1\n",
+	})
+	dstDir := newModule(t, "example.com/new", map[string]string{
+		"existing.go": "package new\n",
+	})
+
+	opts := testOptions()
+	opts.Strict = true
+	_, err := transplantForTest(t, dstDir, srcDir, opts)
+	if err == nil {
+		t.Fatal("expected the unparsed sources to fail the transplant under -strict")
+	}
+	for _, name := range []string{"gen.go", "tool.go"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("expected the error to report %s: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dstDir, "existing.go")); err != nil {
+		t.Errorf("expected the destination to be left untouched: %v", err)
+	}
+}
+
+func TestRunAndDecodeJSONStreamsConcatenatedObjects(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+	const count = 20000
+	script := `i=0; while [ $i -lt ` + strconv.Itoa(count) + ` ]; do printf '{"ImportPath": "example.com/p%d", "Deps": ["fmt", "os"]}\n' $i; i=$((i+1)); done`
+
+	var seen int
+	err := runAndDecodeJSON(exec.Command("sh", "-c", script), func(decoder *json.Decoder) error {
+		for decoder.More() {
+			var info packageInfo
+			if err := decoder.Decode(&info); err != nil {
+				return err
+			}
+			if want := "example.com/p" + strconv.Itoa(seen); info.ImportPath != want {
+				return fmt.Errorf("got %q, want %q", info.ImportPath, want)
+			}
+			seen++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen != count {
+		t.Errorf("decoded %d objects, want %d", seen, count)
+	}
+
+	t.Run("single object", func(t *testing.T) {
+		var info packageInfo
+		err := runAndParseJSON(exec.Command("sh", "-c", `echo '{"ImportPath": "a"}{"ImportPath": "b"}'`), &info)
+		if err == nil || !strings.Contains(err.Error(), "unexpected data after JSON object") {
+			t.Fatalf("expected trailing objects to be rejected, got %v", err)
+		}
+	})
+
+	t.Run("command failure", func(t *testing.T) {
+		var info packageInfo
+		err := runAndParseJSON(exec.Command("sh", "-c", `echo broken >&2; exit 1`), &info)
+		if err == nil || !strings.Contains(err.Error(), "broken") {
+			t.Fatalf("expected the command's stderr in the error, got %v", err)
+		}
+	})
+}
+
+// testOptions returns the options of a run without flags, except that Go
+// files are formatted with gofmt so that goimports need not be installed.
+func testOptions() *Options {
+	return &Options{
+		LocalImports:  true,
+		IgnoreTagged:  ignoreTaggedCopy,
+		TidyOrder:     tidyOrderBefore,
+		TidyErrors:    tidyErrorsFail,
+		NoImportPrune: true,
+	}
+}
+
+// newModule writes a module with the given path and files into a new
+// temporary directory and returns the directory.
+func newModule(t *testing.T, modulePath string, files map[string]string) string {
+	t.Helper()
+	if _, err := exec.LookPath(goBin); err != nil {
+		t.Skipf("go command not found: %v", err)
+	}
+	dir := t.TempDir()
+	writeFiles(t, dir, files)
+	writeFiles(t, dir, map[string]string{"go.mod": "module " + modulePath + "\n\ngo 1.21\n"})
+	return dir
+}
+
+// transplantForTest transplants srcDir into dstDir, returning the work.
+func transplantForTest(t *testing.T, dstDir, srcDir string, opts *Options) (*Work, error) {
+	t.Helper()
+	if err := setModes(opts); err != nil {
+		t.Fatal(err)
+	}
+	return transplant(dstDir, srcDir, opts)
+}
+
+// buildModule fails the test if the packages of the module in dir do not
+// build.
+func buildModule(t *testing.T, dir string) {
+	t.Helper()
+	if output, err := execInDirCombinedOutput(dir, goBin, "build", "./..."); err != nil {
+		t.Fatalf("destination does not build: %v\n%s", err, output)
+	}
+}
+
+// makeReadOnly removes write permission from everything beneath dir, as in
+// the module cache, restoring it when the test finishes so that the
+// directory can be removed.
+func makeReadOnly(t *testing.T, dir string) {
+	t.Helper()
+	chmodAll := func(fileMode, dirMode os.FileMode) error {
+		return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+			switch {
+			case err != nil:
+				return err
+			case entry.IsDir():
+				return os.Chmod(path, dirMode)
+			default:
+				return os.Chmod(path, fileMode)
+			}
+		})
+	}
+	t.Cleanup(func() {
+		if err := chmodAll(0644, 0755); err != nil {
+			t.Error(err)
+		}
+	})
+	if err := chmodAll(0444, 0555); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// writeFiles writes the files, keyed by slash-separated path relative to dir,
+// creating directories as needed.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for rel, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/zeebo/errs"
+)
+
+// defaultManifestName is the conventional name of the manifest, which is only
+// written when -manifest is set.
+const defaultManifestName = "mirage-manifest.json"
+
+const (
+	fileKindGo        = "go"
+	fileKindOther     = "other"
+	fileKindGenerated = "generated"
+)
+
+// Manifest records the files managed by a transplant so that later runs can
+// reconcile the destination against what was previously written.
+type Manifest struct {
+	SrcImportPath string         `json:"srcImportPath"`
+	DstModule     string         `json:"dstModule"`
+	Fingerprint   string         `json:"fingerprint,omitempty"`
+	Toolchain     *Toolchain     `json:"toolchain,omitempty"`
+	LOC           *LOC           `json:"loc,omitempty"`
+	Files         []ManifestFile `json:"files"`
+}
+
+// ManifestFile describes a single managed destination file. Src is relative
+// to the source module directory and Dst is relative to the destination
+// directory, both using forward slashes. SHA256 is the hash of the
+// destination file and SrcSHA256 the hash of the source file it came from.
+type ManifestFile struct {
+	Kind      string `json:"kind"`
+	Src       string `json:"src,omitempty"`
+	Dst       string `json:"dst"`
+	SHA256    string `json:"sha256"`
+	SrcSHA256 string `json:"srcSha256,omitempty"`
+}
+
+// manifestPath returns the path of the manifest for the work, or an empty
+// string if the manifest is disabled.
+func manifestPath(work *Work, opts *Options) string {
+	switch {
+	case opts.Manifest == "":
+		return ""
+	case filepath.IsAbs(opts.Manifest):
+		return opts.Manifest
+	default:
+		return filepath.Join(work.DstDir, opts.Manifest)
+	}
+}
+
+// readManifest reads the manifest at path. A missing manifest is not an error
+// and results in a nil manifest.
+func readManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return nil, nil
+	case err != nil:
+		return nil, errs.Wrap(err)
+	}
+
+	manifest := new(Manifest)
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+func writeManifest(path string, manifest *Manifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	if err := writeFile(path, append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// buildManifest describes the destination files written for the work.
+func buildManifest(work *Work, fingerprint string, toolchain *Toolchain) (*Manifest, error) {
+	manifest := &Manifest{
+		SrcImportPath: work.SrcImportPath,
+		DstModule:     work.DstModule,
+		Fingerprint:   fingerprint,
+		Toolchain:     toolchain,
+	}
+
+	add := func(kind string, files map[string]string) error {
+		for src, dst := range files {
+			file, err := work.manifestFile(kind, src, dst)
+			if err != nil {
+				return err
+			}
+			manifest.Files = append(manifest.Files, file)
+		}
+		return nil
+	}
+	if err := add(fileKindGo, work.GoFiles); err != nil {
+		return nil, err
+	}
+	if err := add(fileKindOther, work.OtherFiles); err != nil {
+		return nil, err
+	}
+	for dst := range work.GeneratedFiles {
+		file, err := work.manifestFile(fileKindGenerated, "", dst)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+
+	sort.Slice(manifest.Files, func(i, j int) bool {
+		return manifest.Files[i].Dst < manifest.Files[j].Dst
+	})
+	return manifest, nil
+}
+
+func (w *Work) manifestFile(kind, src, dst string) (ManifestFile, error) {
+	var srcRel, srcSum string
+	if src != "" {
+		var err error
+		srcRel, err = relPath(w.SrcModuleDir, src)
+		if err != nil {
+			return ManifestFile{}, err
+		}
+		srcSum, err = hashFile(src)
+		if err != nil {
+			return ManifestFile{}, fmt.Errorf("failed to hash %q: %w", src, err)
+		}
+	}
+	dstRel, err := relPath(w.DstDir, dst)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	sum, err := hashFile(dst)
+	if err != nil {
+		return ManifestFile{}, fmt.Errorf("failed to hash %q: %w", dst, err)
+	}
+	return ManifestFile{
+		Kind:      kind,
+		Src:       srcRel,
+		Dst:       dstRel,
+		SHA256:    sum,
+		SrcSHA256: srcSum,
+	}, nil
+}
+
+// pruneStaleOtherFiles removes the non-Go files recorded in the prior
+// manifest that the work no longer produces. It returns the destination paths
+// that were removed.
+func pruneStaleOtherFiles(work *Work, prior *Manifest) ([]string, error) {
+	planned := make(map[string]struct{}, len(work.OtherFiles))
+	for _, dst := range work.OtherFiles {
+		planned[filepath.Clean(dst)] = struct{}{}
+	}
+
+	var pruned []string
+	for _, file := range prior.Files {
+		if file.Kind != fileKindOther {
+			continue
+		}
+		if !filepath.IsLocal(filepath.FromSlash(file.Dst)) {
+			return nil, fmt.Errorf("manifest entry %q is outside of the destination", file.Dst)
+		}
+		dst := filepath.Join(work.DstDir, filepath.FromSlash(file.Dst))
+		if _, ok := planned[dst]; ok {
+			continue
+		}
+		switch err := os.Remove(dst); {
+		case errors.Is(err, fs.ErrNotExist):
+			continue
+		case err != nil:
+			return nil, errs.Wrap(err)
+		}
+		pruned = append(pruned, dst)
+	}
+	return pruned, nil
+}
+
+// relPath returns target relative to base using forward slashes.
+func relPath(base, target string) (string, error) {
+	absBase, err := filepath.Abs(base)
+	if err != nil {
+		return "", errs.Wrap(err)
+	}
+	absTarget, err := filepath.Abs(target)
+	if err != nil {
+		return "", errs.Wrap(err)
+	}
+	rel, err := filepath.Rel(absBase, absTarget)
+	if err != nil {
+		return "", errs.Wrap(err)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", errs.Wrap(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", errs.Wrap(err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checkUnmanagedPackages ensures the destination directory of each
+// dependency package does not already hold Go files that were not written by
+// a prior transplant (according to the prior manifest, which may be nil, or
+// the shared manifests of other transplants).
+func (w *Work) checkUnmanagedPackages(prior *Manifest, shared map[string]ManifestFile) error {
+	managed := make(map[string]bool)
+	if prior != nil {
+		for _, file := range prior.Files {
+			managed[filepath.Join(w.DstDir, filepath.FromSlash(file.Dst))] = true
+		}
+	}
+	for path := range shared {
+		managed[path] = true
+	}
+
+	var conflicts []string
+	for _, pkg := range w.Packages {
+		if filepath.Clean(pkg.DstDir) == filepath.Clean(w.DstDir) {
+			continue
+		}
+		entries, err := os.ReadDir(pkg.DstDir)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			continue
+		case err != nil:
+			return errs.Wrap(err)
+		}
+		for _, entry := range entries {
+			path := filepath.Join(pkg.DstDir, entry.Name())
+			if !entry.IsDir() && filepath.Ext(path) == ".go" && !managed[path] {
+				conflicts = append(conflicts, fmt.Sprintf("%s (destination of %s)", pkg.DstDir, pkg.SrcImportPath))
+				break
+			}
+		}
+	}
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return fmt.Errorf("destination already contains unmanaged packages that would be overwritten (use -force to proceed anyway):\n  %s", strings.Join(conflicts, "\n  "))
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTransplantRefusesUnmanagedDependencyPackages(t *testing.T) {
+	srcDir := newModule(t, "example.com/old", map[string]string{
+		"foo.go":                "package foo\n\nimport \"example.com/old/internal/util\"\n\nvar Foo = util.Util\n",
+		"internal/util/util.go": "package util\n\nvar Util = 1\n",
+	})
+	handWritten := "package util\n\nvar Mine = 1\n"
+
+	for _, manifest := range []string{"", defaultManifestName} {
+		t.Run("manifest="+manifest, func(t *testing.T) {
+			dstDir := newModule(t, "example.com/new", map[string]string{
+				"internal/util/mine.go": handWritten,
+			})
+
+			opts := testOptions()
+			opts.Manifest = manifest
+			_, err := transplantForTest(t, dstDir, srcDir, opts)
+			if err == nil || !strings.Contains(err.Error(), "unmanaged packages") {
+				t.Fatalf("expected the hand-written package to be refused, got %v", err)
+			}
+			if got := readFile(t, filepath.Join(dstDir, "internal", "util", "mine.go")); got != handWritten {
+				t.Errorf("expected the hand-written package to be left alone, got:\n%s", got)
+			}
+
+			opts = testOptions()
+			opts.Manifest = manifest
+			opts.Force = true
+			if _, err := transplantForTest(t, dstDir, srcDir, opts); err != nil {
+				t.Fatalf("expected -force to overwrite the package: %v", err)
+			}
+		})
+	}
+}
+
+func TestTransplantWithManifestOverwritesManagedDependencyPackages(t *testing.T) {
+	srcDir := newModule(t, "example.com/old", map[string]string{
+		"foo.go":                "package foo\n\nimport \"example.com/old/internal/util\"\n\nvar Foo = util.Util\n",
+		"internal/util/util.go": "package util\n\nvar Util = 1\n",
+	})
+	dstDir := newModule(t, "example.com/new", nil)
+
+	for i := 0; i < 2; i++ {
+		opts := testOptions()
+		opts.Manifest = defaultManifestName
+		if _, err := transplantForTest(t, dstDir, srcDir, opts); err != nil {
+			t.Fatalf("run %d: %v", i+1, err)
+		}
+	}
+	buildModule(t, dstDir)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zeebo/errs"
+)
+
+// parseMappings parses the custom import path mappings given via -map and
+// -map-file into a map from source import path to destination import path.
+// Each mapping has the form SRC=DST. Map files hold one mapping per line;
+// blank lines and lines beginning with # are ignored.
+func parseMappings(mappings []string, mapFile string) (map[string]string, error) {
+	parsed := make(map[string]string)
+	add := func(mapping, where string) error {
+		src, dst, ok := strings.Cut(mapping, "=")
+		src, dst = strings.TrimSpace(src), strings.TrimSpace(dst)
+		if !ok || src == "" || dst == "" {
+			return fmt.Errorf("invalid mapping %q%s: expected SRC=DST", mapping, where)
+		}
+		if existing, ok := parsed[src]; ok && existing != dst {
+			return fmt.Errorf("conflicting mappings for %q%s: %q and %q", src, where, existing, dst)
+		}
+		parsed[src] = dst
+		return nil
+	}
+
+	if mapFile != "" {
+		f, err := os.Open(mapFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open map file: %w", err)
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+
+		scanner := bufio.NewScanner(f)
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" || strings.HasPrefix(text, "#") {
+				continue
+			}
+			if err := add(text, fmt.Sprintf(" at %s:%d", mapFile, line)); err != nil {
+				return nil, err
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, errs.Wrap(err)
+		}
+	}
+
+	for _, mapping := range mappings {
+		if err := add(mapping, ""); err != nil {
+			return nil, err
+		}
+	}
+	return parsed, nil
+}
+
+// countImports adds the imports in the Go source data that will be replaced
+// (those of the paths) to the counts in used. Only import declarations count;
+// the same path in a string literal or comment is not a use of a mapping.
+func countImports(used map[string]int, paths map[string]string, srcPath string, data []byte) {
+	// A file that does not parse has already been warned about; whatever
+	// imports were parsed still count.
+	file, _ := parser.ParseFile(token.NewFileSet(), srcPath, data, parser.ImportsOnly)
+	if file == nil {
+		return
+	}
+	for _, spec := range file.Imports {
+		importPath, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			continue
+		}
+		if _, ok := paths[importPath]; ok {
+			used[importPath]++
+		}
+	}
+}
+
+// unusedMappings returns the source import paths of the custom mappings that
+// were never applied, according to the replacement counts.
+func unusedMappings(mappings map[string]string, used map[string]int) []string {
+	var unused []string
+	for src := range mappings {
+		if used[src] == 0 {
+			unused = append(unused, src)
+		}
+	}
+	sort.Strings(unused)
+	return unused
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
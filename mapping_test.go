@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCountImportsIgnoresLiteralsAndComments(t *testing.T) {
+	src := `package foo
+
+import (
+	"example.com/old/a"
+	b "example.com/old/b"
+)
+
+// See "example.com/old/c" for details.
+const cPath = "example.com/old/c"
+
+var _ = a.A
+var _ = b.B
+`
+	paths := map[string]string{
+		"example.com/old/a": "example.com/new/a",
+		"example.com/old/b": "example.com/new/b",
+		"example.com/old/c": "example.com/new/c",
+	}
+	used := make(map[string]int)
+	countImports(used, paths, "foo.go", []byte(src))
+
+	want := map[string]int{"example.com/old/a": 1, "example.com/old/b": 1}
+	if len(used) != len(want) {
+		t.Fatalf("got counts %v, want %v", used, want)
+	}
+	for path, count := range want {
+		if used[path] != count {
+			t.Errorf("got %d uses of %s, want %d", used[path], path, count)
+		}
+	}
+	if got := unusedMappings(paths, used); len(got) != 1 || got[0] != "example.com/old/c" {
+		t.Errorf("got unused mappings %v, want [example.com/old/c]", got)
+	}
+}
+
+func TestStrictUnusedMappingFailsBeforeWriting(t *testing.T) {
+	srcDir := newModule(t, "example.com/old", map[string]string{
+		"foo.go": "package foo\n\nfunc Foo() int { return 1 }\n",
+	})
+	dstDir := newModule(t, "example.com/new", map[string]string{
+		"existing.go": "package new\n",
+	})
+
+	opts := testOptions()
+	opts.Strict = true
+	opts.ReportUnusedMappings = true
+	opts.Mappings = []string{"example.com/unused=example.com/new/unused"}
+	if _, err := transplantForTest(t, dstDir, srcDir, opts); err == nil {
+		t.Fatal("expected the unused mapping to fail the transplant under -strict")
+	}
+	if _, err := os.Stat(filepath.Join(dstDir, "existing.go")); err != nil {
+		t.Errorf("expected the destination to be left untouched: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dstDir, "foo.go")); !os.IsNotExist(err) {
+		t.Errorf("expected foo.go not to be copied (err=%v)", err)
+	}
+}
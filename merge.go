@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// prepareMerge readies the work to be merged into packages that already
+// exist in the destination. Incoming Go files whose names collide with
+// existing files are renamed using a prefix derived from the source package.
+// Incoming top-level identifiers that are already declared by the
+// destination package are renamed where possible (exported ones only if
+// allowExportRename is set) and otherwise reported as an error before
+// anything is written.
+func (w *Work) prepareMerge(allowExportRename bool) error {
+	byDir := make(map[string][]string)
+	for src, dst := range w.GoFiles {
+		dir := filepath.Dir(dst)
+		byDir[dir] = append(byDir[dir], src)
+	}
+
+	for dir, srcs := range byDir {
+		sort.Strings(srcs)
+
+		existing, err := readPackageDecls(dir)
+		if err != nil {
+			return fmt.Errorf("failed to inspect destination package %q: %w", dir, err)
+		}
+		if len(existing.Files) == 0 {
+			continue
+		}
+
+		taken := make(map[string]bool)
+		for ident := range existing.Idents {
+			taken[ident] = true
+		}
+		allDecls := make(map[string]*fileDecls)
+		for _, src := range srcs {
+			decls, err := readFileDecls(src)
+			if err != nil {
+				return fmt.Errorf("failed to inspect source file %q: %w", src, err)
+			}
+			allDecls[src] = decls
+			for _, ident := range decls.Idents {
+				taken[ident] = true
+			}
+		}
+
+		var duplicates []string
+		for _, src := range srcs {
+			decls := allDecls[src]
+			pkg := w.packageForFile(src)
+			name := decls.Name
+			if pkg != nil {
+				name = w.dstPackageName(pkg)
+			}
+			if !decls.IsTest && existing.Name != "" && name != existing.Name {
+				return fmt.Errorf("cannot merge %q into destination package %q: package name %q does not match", src, existing.Name, name)
+			}
+			for _, ident := range decls.Idents {
+				file, ok := existing.Idents[ident]
+				switch {
+				case !ok:
+				case pkg == nil:
+					duplicates = append(duplicates, fmt.Sprintf("%s (declared in %s and %s)", ident, src, file))
+				default:
+					if _, err := w.renameIdent(pkg, ident, taken, allowExportRename); err != nil {
+						duplicates = append(duplicates, fmt.Sprintf("%s (declared in %s and %s; %v)", ident, src, file, err))
+					}
+				}
+			}
+
+			dst := w.GoFiles[src]
+			if _, ok := existing.Files[filepath.Base(dst)]; ok {
+				renamed := filepath.Join(dir, mergePrefix(src)+filepath.Base(dst))
+				if _, ok := existing.Files[filepath.Base(renamed)]; ok {
+					return fmt.Errorf("cannot merge %q: both %q and %q already exist in the destination", src, dst, renamed)
+				}
+				w.GoFiles[src] = renamed
+			}
+		}
+
+		if len(duplicates) > 0 {
+			return fmt.Errorf("cannot merge into %q; duplicate top-level identifiers:\n  %s", dir, strings.Join(duplicates, "\n  "))
+		}
+	}
+	return nil
+}
+
+// mergePrefix returns the prefix used to rename an incoming file whose name
+// collides with an existing destination file.
+func mergePrefix(src string) string {
+	return filepath.Base(filepath.Dir(src)) + "_"
+}
+
+type fileDecls struct {
+	Name   string
+	IsTest bool
+	Idents []string
+}
+
+type packageDecls struct {
+	Name   string
+	Files  map[string]struct{}
+	Idents map[string]string
+}
+
+// readPackageDecls collects the package name, file names, and top-level
+// identifiers of the Go files directly within dir. A missing directory is
+// treated as an empty package.
+func readPackageDecls(dir string) (*packageDecls, error) {
+	pkg := &packageDecls{
+		Files:  make(map[string]struct{}),
+		Idents: make(map[string]string),
+	}
+
+	entries, err := os.ReadDir(dir)
+	switch {
+	case os.IsNotExist(err):
+		return pkg, nil
+	case err != nil:
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".go" {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		pkg.Files[entry.Name()] = struct{}{}
+
+		decls, err := readFileDecls(path)
+		if err != nil {
+			return nil, err
+		}
+		if decls.IsTest {
+			continue
+		}
+		if pkg.Name == "" {
+			pkg.Name = decls.Name
+		}
+		for _, ident := range decls.Idents {
+			pkg.Idents[ident] = path
+		}
+	}
+	return pkg, nil
+}
+
+// readFileDecls parses the Go file at path and returns its package name and
+// the names of its top-level declarations (excluding methods, init, and the
+// blank identifier).
+func readFileDecls(path string) (*fileDecls, error) {
+	file, err := parser.ParseFile(token.NewFileSet(), path, nil, parser.SkipObjectResolution)
+	if err != nil {
+		return nil, err
+	}
+
+	decls := &fileDecls{
+		Name:   file.Name.Name,
+		IsTest: strings.HasSuffix(path, "_test.go"),
+	}
+	add := func(ident *ast.Ident) {
+		if ident.Name != "_" && ident.Name != "init" {
+			decls.Idents = append(decls.Idents, ident.Name)
+		}
+	}
+	for _, decl := range file.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			if decl.Recv == nil {
+				add(decl.Name)
+			}
+		case *ast.GenDecl:
+			for _, spec := range decl.Specs {
+				switch spec := spec.(type) {
+				case *ast.TypeSpec:
+					add(spec.Name)
+				case *ast.ValueSpec:
+					for _, name := range spec.Names {
+						add(name)
+					}
+				}
+			}
+		}
+	}
+	return decls, nil
+}
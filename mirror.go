@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/zeebo/errs"
+)
+
+// planFingerprint summarizes the parts of the work and options that affect
+// the content of the destination files beyond the source files themselves.
+// Unchanged files are only skipped by -mirror when it matches the prior run.
+func planFingerprint(work *Work, opts *Options) string {
+	h := sha256.New()
+	paths := work.packagePaths()
+	for _, srcPkg := range sortedKeys(paths) {
+		fmt.Fprintln(h, srcPkg, paths[srcPkg])
+	}
+	for _, srcPkg := range sortedKeys(work.PackageRenames) {
+		fmt.Fprintln(h, srcPkg, work.PackageRenames[srcPkg])
+	}
+	for _, srcPkg := range sortedKeys(work.IdentRenames) {
+		renames := work.IdentRenames[srcPkg]
+		for _, old := range sortedKeys(renames) {
+			fmt.Fprintln(h, srcPkg, old, renames[old])
+		}
+	}
+	fmt.Fprintln(h, opts.LocalImports, opts.LocalPrefix, opts.FormatGenerated, opts.RewriteAsm, opts.FlattenDeps, opts.NoImportPrune, opts.PreferSourceOrder, opts.EOL, opts.FileMode, opts.DirMode)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// reconcileMirror brings the destination in line with the work based on the
+// prior manifest. Managed files that the work no longer produces are removed
+// (along with any directories left empty). It returns the destination paths
+// whose content is known to be unchanged since the prior run so they can be
+// skipped.
+func reconcileMirror(work *Work, prior *Manifest, fingerprint string) (map[string]bool, error) {
+	planned := make(map[string]string)
+	for src, dst := range work.GoFiles {
+		planned[filepath.Clean(dst)] = src
+	}
+	for src, dst := range work.OtherFiles {
+		planned[filepath.Clean(dst)] = src
+	}
+	for dst := range work.GeneratedFiles {
+		planned[filepath.Clean(dst)] = ""
+	}
+
+	unchanged := make(map[string]bool)
+	for _, file := range prior.Files {
+		if !filepath.IsLocal(filepath.FromSlash(file.Dst)) {
+			return nil, fmt.Errorf("manifest entry %q is outside of the destination", file.Dst)
+		}
+		dst := filepath.Join(work.DstDir, filepath.FromSlash(file.Dst))
+
+		src, ok := planned[dst]
+		if !ok {
+			logger.Info("Removing stale managed file", "dst", dst)
+			if err := os.Remove(dst); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return nil, errs.Wrap(err)
+			}
+			work.removed = append(work.removed, dst)
+			if err := pruneEmptyParents(work.DstDir, filepath.Dir(dst)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		dstSum, err := hashFile(dst)
+		if err != nil || dstSum != file.SHA256 {
+			// Missing or modified since the prior run
+			continue
+		}
+
+		if src == "" {
+			if sum := sha256.Sum256(work.GeneratedFiles[dst]); hex.EncodeToString(sum[:]) == file.SHA256 {
+				unchanged[dst] = true
+			}
+			continue
+		}
+
+		srcRel, err := relPath(work.SrcModuleDir, src)
+		if err != nil {
+			return nil, err
+		}
+		if prior.Fingerprint != fingerprint || srcRel != file.Src {
+			continue
+		}
+		if srcSum, err := hashFile(src); err == nil && srcSum == file.SrcSHA256 {
+			unchanged[dst] = true
+		}
+	}
+	return unchanged, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReconcileMirrorPrunesStaleFilesInRelativeDst(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"keep/keep.go":    "package keep\n",
+		"stale/stale.go":  "package stale\n",
+		"stale/sub/x.txt": "x\n",
+	})
+	chdir(t, dir)
+
+	work := &Work{DstDir: "."}
+	prior := &Manifest{Files: []ManifestFile{
+		{Kind: fileKindGo, Dst: "stale/stale.go"},
+		{Kind: fileKindOther, Dst: "stale/sub/x.txt"},
+		// Removed by hand since the prior run, along with its directory.
+		{Kind: fileKindGo, Dst: "gone/gone.go"},
+	}}
+	if _, err := reconcileMirror(work, prior, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "stale")); !os.IsNotExist(err) {
+		t.Errorf("expected the directory of the stale files to be pruned (err=%v)", err)
+	}
+	if !fileExists(filepath.Join(dir, "keep", "keep.go")) {
+		t.Error("expected the unmanaged file to be kept")
+	}
+}
+
+func TestPlanFingerprintCoversOutputOptions(t *testing.T) {
+	base := planFingerprint(&Work{}, testOptions())
+	for name, set := range map[string]func(*Options){
+		"eol":       func(opts *Options) { opts.EOL = eolCRLF },
+		"file-mode": func(opts *Options) { opts.FileMode = 0600 },
+		"dir-mode":  func(opts *Options) { opts.DirMode = 0700 },
+	} {
+		opts := testOptions()
+		set(opts)
+		if planFingerprint(&Work{}, opts) == base {
+			t.Errorf("expected -%s to change the fingerprint", name)
+		}
+	}
+}
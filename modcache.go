@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zeebo/errs"
+)
+
+// moduleCacheListFlags returns the go list flags needed for a source
+// directory inside the read-only module cache, along with a function to clean
+// up after them. go list is pointed at a writable copy of the module's go.mod
+// (and go.sum) via -modfile so it can record any missing checksums without
+// touching the cache. No flags are needed for sources outside the cache.
+func moduleCacheListFlags(srcDir string) (_ []string, cleanup func(), err error) {
+	cleanup = func() {}
+
+	env := &struct {
+		GOMODCACHE string
+	}{}
+	if err := execInDirAndParseJSON(srcDir, env, goBin, "env", "-json", "GOMODCACHE"); err != nil {
+		return nil, cleanup, err
+	}
+	if env.GOMODCACHE == "" {
+		return nil, cleanup, nil
+	}
+
+	absSrcDir, err := filepath.Abs(srcDir)
+	if err != nil {
+		return nil, cleanup, errs.Wrap(err)
+	}
+	rel, err := filepath.Rel(env.GOMODCACHE, absSrcDir)
+	if err != nil || !filepath.IsLocal(rel) {
+		return nil, cleanup, nil
+	}
+
+	// Find the root of the versioned module directory holding the source.
+	modDir := absSrcDir
+	for !fileExists(filepath.Join(modDir, "go.mod")) {
+		parent := filepath.Dir(modDir)
+		if parent == modDir || !strings.HasPrefix(parent, env.GOMODCACHE) {
+			return nil, cleanup, nil
+		}
+		modDir = parent
+	}
+
+	tmpDir, err := os.MkdirTemp("", "mirage-modfile-")
+	if err != nil {
+		return nil, cleanup, errs.Wrap(err)
+	}
+	cleanup = func() {
+		_ = os.RemoveAll(tmpDir)
+	}
+
+	if err := copyOtherFile(filepath.Join(modDir, "go.mod"), filepath.Join(tmpDir, "go.mod")); err != nil {
+		cleanup()
+		return nil, func() {}, err
+	}
+	if goSum := filepath.Join(modDir, "go.sum"); fileExists(goSum) {
+		if err := copyOtherFile(goSum, filepath.Join(tmpDir, "go.sum")); err != nil {
+			cleanup()
+			return nil, func() {}, err
+		}
+	}
+
+	logger.Debug("Source is in the module cache", "module", modDir)
+	return []string{"-mod=mod", "-modfile=" + filepath.Join(tmpDir, "go.mod")}, cleanup, nil
+}
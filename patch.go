@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/zeebo/errs"
+)
+
+// writePatch performs the transplant against a copy of the destination and
+// writes a unified diff of everything it changed to the -patch file (or
+// stdout for "-"), leaving the destination itself untouched. The diff is
+// relative to the destination directory, so it can be applied there with git
+// apply.
+func writePatch(dstDir, srcDir string, opts *Options) (err error) {
+	tmpDir, err := os.MkdirTemp("", "mirage-patch-")
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	if err := copySandboxDst(dstDir, filepath.Join(tmpDir, "a"), opts); err != nil {
+		return err
+	}
+	if _, err := sandboxTransplant(dstDir, srcDir, filepath.Join(tmpDir, "b"), opts); err != nil {
+		return err
+	}
+
+	out := io.Writer(os.Stdout)
+	if opts.Patch != "-" {
+		f, err := os.Create(opts.Patch)
+		if err != nil {
+			return fmt.Errorf("failed to create patch file: %w", err)
+		}
+		defer func() {
+			if closeErr := f.Close(); err == nil {
+				err = errs.Wrap(closeErr)
+			}
+		}()
+		out = f
+	}
+	return diffDirs(tmpDir, "a", "b", out)
+}
+
+// sandboxTransplant copies the destination to sandboxDir, which must not
+// exist, and performs the transplant there instead, leaving the destination
+// untouched. Files the transplant would otherwise write outside of the
+// destination (the manifest, if given an absolute path, the summary, and the
+// API dump) are written beside the sandbox instead.
+func sandboxTransplant(dstDir, srcDir, sandboxDir string, opts *Options) (*Work, error) {
+	logger.Info("Copying destination to a sandbox...")
+	if err := copySandboxDst(dstDir, sandboxDir, opts); err != nil {
+		return nil, err
+	}
+
+	sandboxOpts := *opts
+	sandboxOpts.Patch = ""
+	sandboxOpts.DryRun = false
+	if filepath.IsAbs(opts.Manifest) {
+		sandboxOpts.Manifest = sandboxDir + ".manifest.json"
+		if fileExists(opts.Manifest) {
+			if err := copyOtherFile(opts.Manifest, sandboxOpts.Manifest); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if opts.SummaryJSON != "" {
+		sandboxOpts.SummaryJSON = sandboxDir + ".summary.json"
+	}
+	if opts.APIDump != "" {
+		sandboxOpts.APIDump = sandboxDir + ".api.txt"
+	}
+
+	if sandboxOpts.Init {
+		if err := initDst(sandboxDir, &sandboxOpts); err != nil {
+			return nil, err
+		}
+	}
+	work, err := getWork(sandboxDir, srcDir, &sandboxOpts)
+	if err != nil {
+		return nil, err
+	}
+	if err := doWork(work, &sandboxOpts); err != nil {
+		return nil, err
+	}
+	return work, nil
+}
+
+// copySandboxDst copies the destination to dir. With -init, a destination
+// that does not exist yet is copied as an empty directory, since the
+// transplant would create it.
+func copySandboxDst(dstDir, dir string, opts *Options) error {
+	if opts.Init {
+		if _, err := os.Stat(dstDir); errors.Is(err, fs.ErrNotExist) {
+			return errs.Wrap(os.MkdirAll(dir, 0755))
+		}
+	}
+	if err := copyTree(dstDir, dir); err != nil {
+		return fmt.Errorf("failed to copy destination: %w", err)
+	}
+	return nil
+}
+
+// diffDirs writes a unified git diff from directory a to directory b, both
+// relative to dir. The directories are named in place of the usual a/ and b/
+// prefixes, so naming them a and b produces a conventional diff.
+func diffDirs(dir, a, b string, out io.Writer) error {
+	cmd := exec.Command("git", "diff", "--no-index", "--no-prefix", "--no-color", "--binary", "--", a, b)
+	cmd.Dir = dir
+	cmd.Stdout = out
+	cmd.Stderr = os.Stderr
+	start := time.Now()
+	err := cmd.Run()
+	observeExec(cmd, start, err)
+	// git diff exits with status 1 when the directories differ.
+	var exitErr *exec.ExitError
+	if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 1) {
+		return fmt.Errorf("failed to diff %q and %q: %w", a, b, err)
+	}
+	return nil
+}
+
+// copyTree copies the directory tree at src to dst, preserving file modes
+// and symlinks. Version control directories are not copied.
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, entry fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return errs.Wrap(walkErr)
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return errs.Wrap(err)
+		}
+		target := filepath.Join(dst, rel)
+
+		info, err := entry.Info()
+		if err != nil {
+			return errs.Wrap(err)
+		}
+		switch {
+		case entry.IsDir() && (entry.Name() == ".git" || entry.Name() == ".hg" || entry.Name() == ".svn"):
+			return filepath.SkipDir
+		case entry.IsDir():
+			return errs.Wrap(os.MkdirAll(target, info.Mode().Perm()|0700))
+		case entry.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return errs.Wrap(err)
+			}
+			return errs.Wrap(os.Symlink(link, target))
+		case !entry.Type().IsRegular():
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return errs.Wrap(err)
+		}
+		return errs.Wrap(os.WriteFile(target, data, info.Mode().Perm()))
+	})
+}
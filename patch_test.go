@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDryRunLeavesNewDestinationAndSummaryUnwritten(t *testing.T) {
+	srcDir := newModule(t, "example.com/old", map[string]string{
+		"foo.go": "package foo\n\nfunc Foo() int { return 1 }\n",
+	})
+	outDir := t.TempDir()
+	dstDir := filepath.Join(outDir, "dst")
+
+	opts := testOptions()
+	opts.Init = true
+	opts.DstModule = "example.com/new"
+	opts.DryRun = true
+	opts.SummaryJSON = filepath.Join(outDir, "summary.json")
+	if err := setModes(opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := dryRun(dstDir, srcDir, opts); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{dstDir, opts.SummaryJSON} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %s not to be written (err=%v)", path, err)
+		}
+	}
+}
+
+func TestWritePatchForNewDestination(t *testing.T) {
+	srcDir := newModule(t, "example.com/old", map[string]string{
+		"foo.go": "package foo\n\nfunc Foo() int { return 1 }\n",
+	})
+	outDir := t.TempDir()
+	dstDir := filepath.Join(outDir, "dst")
+
+	opts := testOptions()
+	opts.Init = true
+	opts.DstModule = "example.com/new"
+	opts.Patch = filepath.Join(outDir, "transplant.patch")
+	if err := setModes(opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := writePatch(dstDir, srcDir, opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dstDir); !os.IsNotExist(err) {
+		t.Errorf("expected the destination not to be created (err=%v)", err)
+	}
+	patch := readFile(t, opts.Patch)
+	for _, want := range []string{"+++ b/go.mod", "+++ b/foo.go", "+module example.com/new"} {
+		if !strings.Contains(patch, want) {
+			t.Errorf("expected the patch to contain %q:\n%s", want, patch)
+		}
+	}
+}
+
+func TestPatchAndDryRunRejectVendorMode(t *testing.T) {
+	dir := t.TempDir()
+	for _, set := range []func(*Options){
+		func(opts *Options) { opts.Patch = "-" },
+		func(opts *Options) { opts.DryRun = true },
+	} {
+		opts := testOptions()
+		opts.VendorMode = true
+		set(opts)
+		err := run(filepath.Join(dir, "dst"), filepath.Join(dir, "src"), opts)
+		if err == nil || !strings.Contains(err.Error(), "-vendor-mode cannot be combined with -patch or -dry-run") {
+			t.Errorf("expected -vendor-mode to be rejected, got %v", err)
+		}
+	}
+}
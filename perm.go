@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	defaultFileMode os.FileMode = 0644
+	defaultDirMode  os.FileMode = 0755
+)
+
+// fileMode and dirMode are the permissions given to the files and directories
+// written to the destination. They are set from Options.FileMode and
+// Options.DirMode.
+var (
+	fileMode = defaultFileMode
+	dirMode  = defaultDirMode
+)
+
+// setModes sets the destination file and directory permissions from the
+// options, falling back to the defaults for zero values.
+func setModes(opts *Options) error {
+	for _, mode := range []struct {
+		name  string
+		value os.FileMode
+	}{{"file", opts.FileMode}, {"dir", opts.DirMode}} {
+		if mode.value&^os.ModePerm != 0 {
+			return fmt.Errorf("invalid %s mode %#o: only permission bits may be set", mode.name, uint32(mode.value))
+		}
+	}
+
+	fileMode, dirMode = defaultFileMode, defaultDirMode
+	if opts.FileMode != 0 {
+		fileMode = opts.FileMode
+	}
+	if opts.DirMode != 0 {
+		dirMode = opts.DirMode
+	}
+	return nil
+}
+
+// writeFile writes data to the file at path with fileMode. Unlike
+// os.WriteFile, the mode is applied regardless of the umask and to files that
+// already exist.
+func writeFile(path string, data []byte) error {
+	if err := os.WriteFile(path, data, fileMode); err != nil {
+		return err
+	}
+	return os.Chmod(path, fileMode)
+}
+
+// ensureDir creates the directory and any missing parents with dirMode.
+// Unlike os.MkdirAll, the mode is applied regardless of the umask. Existing
+// directories are left as they are.
+func ensureDir(dir string) error {
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil || !errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		missing = append(missing, d)
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+	if err := os.MkdirAll(dir, dirMode); err != nil {
+		return err
+	}
+	for _, d := range missing {
+		if err := os.Chmod(d, dirMode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// modeFlag is a flag holding permission bits given in octal.
+type modeFlag os.FileMode
+
+func (f *modeFlag) String() string {
+	if f == nil || *f == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%#o", uint32(*f))
+}
+
+func (f *modeFlag) Set(value string) error {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil {
+		return fmt.Errorf("expected an octal mode (e.g. 0644): %w", err)
+	}
+	if os.FileMode(mode)&^os.ModePerm != 0 {
+		return fmt.Errorf("mode %s has bits other than the permission bits (0777) set", value)
+	}
+	*f = modeFlag(mode)
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/zeebo/errs"
+)
+
+// planVersion is the version of the plan format written by -emit-plan. It is
+// bumped whenever the serialized Work changes, so that older plans are
+// rejected rather than replayed without the fields they lack.
+const planVersion = 3
+
+// Plan is a resolved Work, written with -emit-plan so that the transplant can
+// be executed later with -replay without listing the source packages again.
+type Plan struct {
+	Version int   `json:"version"`
+	Work    *Work `json:"work"`
+}
+
+// emitPlan plans the transplant and writes the plan to path without
+// executing it.
+func emitPlan(dstDir, srcDir, path string, opts *Options) error {
+	logger.Info("Building work...")
+	work, err := getWork(dstDir, srcDir, opts)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(Plan{Version: planVersion, Work: work}, "", "  ")
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	logger.Info("Writing plan...", "path", path)
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write plan: %w", err)
+	}
+	return nil
+}
+
+// replay executes the plan written to path by -emit-plan. Options that only
+// affect planning are ignored, since the plan has already been resolved;
+// options that affect execution (e.g. -mirror or -tidy-errors) apply as
+// usual.
+func replay(path string, opts *Options) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read plan: %w", err)
+	}
+	var plan Plan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return fmt.Errorf("failed to parse plan: %w", err)
+	}
+	switch {
+	case plan.Version != planVersion:
+		return fmt.Errorf("unsupported plan version %d; expected %d", plan.Version, planVersion)
+	case plan.Work == nil:
+		return errors.New("plan has no work")
+	}
+	work := plan.Work
+
+	// The plan is only as good as the source it was made from.
+	var missing []string
+	if work.SrcGoMod != "" && !opts.VendorMode && !fileExists(work.SrcGoMod) {
+		missing = append(missing, work.SrcGoMod)
+	}
+	for _, files := range []map[string]string{work.GoFiles, work.OtherFiles} {
+		for _, src := range sortedKeys(files) {
+			if _, err := os.Lstat(src); err != nil {
+				missing = append(missing, src)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("plan source files no longer exist:\n  %s", strings.Join(missing, "\n  "))
+	}
+
+	if work.GoFiles == nil {
+		work.GoFiles = make(map[string]string)
+	}
+	if work.OtherFiles == nil {
+		work.OtherFiles = make(map[string]string)
+	}
+	if work.GeneratedFiles == nil {
+		work.GeneratedFiles = make(map[string][]byte)
+	}
+	if work.EmbedRewrites == nil {
+		work.EmbedRewrites = make(map[string]map[string]string)
+	}
+	if work.IdentRenames == nil {
+		work.IdentRenames = make(map[string]map[string]string)
+	}
+	work.copiedTo = make(map[string]string)
+	for _, files := range []map[string]string{work.GoFiles, work.OtherFiles} {
+		for src, dst := range files {
+			work.copiedTo[dst] = src
+		}
+	}
+	if err := work.checkDstCollisions(); err != nil {
+		return err
+	}
+
+	logger.Info("Checking destination is writable...")
+	if err := checkDstWritable(work.DstDir); err != nil {
+		return err
+	}
+	return doWork(work, opts)
+}
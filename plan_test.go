@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEmitPlanRejectsSrcRev(t *testing.T) {
+	dir := t.TempDir()
+	opts := testOptions()
+	opts.EmitPlan = filepath.Join(dir, "plan.json")
+	opts.SrcRev = "HEAD~1"
+
+	err := run(filepath.Join(dir, "dst"), filepath.Join(dir, "src"), opts)
+	if err == nil || !strings.Contains(err.Error(), "-emit-plan cannot be combined with -src-rev") {
+		t.Fatalf("expected -emit-plan with -src-rev to be rejected, got %v", err)
+	}
+	if _, err := os.Stat(opts.EmitPlan); !os.IsNotExist(err) {
+		t.Errorf("expected no plan to be written (err=%v)", err)
+	}
+}
+
+func TestReplayRejectsOtherPlanVersions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plan.json")
+	if err := os.WriteFile(path, []byte(`{"version": 2, "work": {}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := replay(path, testOptions())
+	if err == nil || !strings.Contains(err.Error(), "unsupported plan version 2") {
+		t.Fatalf("expected the plan version to be rejected, got %v", err)
+	}
+}
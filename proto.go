@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"strings"
+)
+
+// protoDescriptorPaths returns the source import paths that the protobuf
+// generated Go files among the copied files still reference in their
+// embedded file descriptors, keyed by source file. The descriptors (and the
+// go_package options within them) are serialized into the generated code as
+// string or byte slice literals, which import path rewriting does not touch,
+// so the registered descriptors keep pointing at the source module until the
+// protos are regenerated.
+func (w *Work) protoDescriptorPaths() (map[string][]string, error) {
+	paths := w.packagePaths()
+	refs := make(map[string][]string)
+	for _, src := range sortedKeys(w.GoFiles) {
+		if !strings.HasSuffix(src, ".pb.go") {
+			continue
+		}
+		file, err := parser.ParseFile(token.NewFileSet(), src, nil, parser.SkipObjectResolution)
+		if err != nil {
+			return nil, err
+		}
+		literals := descriptorLiterals(file)
+		for _, srcPkg := range sortedKeys(paths) {
+			for _, literal := range literals {
+				if bytes.Contains(literal, []byte(srcPkg)) {
+					refs[src] = append(refs[src], srcPkg)
+					break
+				}
+			}
+		}
+	}
+	return refs, nil
+}
+
+// descriptorLiterals returns the contents of the string literals and byte
+// slice literals in the file outside of its imports.
+func descriptorLiterals(file *ast.File) [][]byte {
+	var literals [][]byte
+	for _, decl := range file.Decls {
+		ast.Inspect(decl, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.ImportSpec:
+				return false
+			case *ast.BasicLit:
+				if n.Kind == token.STRING {
+					if value, err := strconv.Unquote(n.Value); err == nil {
+						literals = append(literals, []byte(value))
+					}
+				}
+			case *ast.CompositeLit:
+				if data, ok := byteSliceLiteral(n); ok {
+					literals = append(literals, data)
+					return false
+				}
+			}
+			return true
+		})
+	}
+	return literals
+}
+
+// byteSliceLiteral returns the bytes of a composite literal made up entirely
+// of integer or character literals, such as a serialized raw descriptor.
+func byteSliceLiteral(lit *ast.CompositeLit) ([]byte, bool) {
+	if len(lit.Elts) == 0 {
+		return nil, false
+	}
+	data := make([]byte, 0, len(lit.Elts))
+	for _, elt := range lit.Elts {
+		basic, ok := elt.(*ast.BasicLit)
+		if !ok || (basic.Kind != token.INT && basic.Kind != token.CHAR) {
+			return nil, false
+		}
+		value, err := strconv.ParseUint(basic.Value, 0, 8)
+		if basic.Kind == token.CHAR {
+			var r rune
+			r, _, _, err = strconv.UnquoteChar(strings.Trim(basic.Value, "'"), '\'')
+			value = uint64(r)
+		}
+		if err != nil || value > 0xff {
+			return nil, false
+		}
+		data = append(data, byte(value))
+	}
+	return data, true
+}
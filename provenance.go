@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// provenanceFileName is the name of the file written into each destination
+// package with -provenance. It is guarded by a build constraint that is never
+// satisfied so it does not affect the build.
+const provenanceFileName = "mirage.go"
+
+// provenanceHeader begins every provenance file.
+const provenanceHeader = "//go:build mirage_ignore\n\n// Code generated by mirage. DO NOT EDIT.\n\n"
+
+// addProvenance plans a provenance file for each destination package
+// recording the source import path(s) and commit it was transplanted from.
+// Unless force is set, it refuses to overwrite an existing destination file
+// that is neither managed by the prior manifest (which may be nil) nor a
+// provenance file written by an earlier run.
+func (w *Work) addProvenance(prior *Manifest, force bool) error {
+	commit := sourceCommit(w.SrcModuleDir)
+	managed := make(map[string]bool)
+	if prior != nil {
+		for _, file := range prior.Files {
+			managed[filepath.Join(w.DstDir, filepath.FromSlash(file.Dst))] = true
+		}
+	}
+
+	type provenance struct {
+		name    string
+		sources []string
+	}
+	byDir := make(map[string]*provenance)
+	for _, pkg := range w.Packages {
+		p, ok := byDir[pkg.DstDir]
+		if !ok {
+			p = &provenance{name: w.dstPackageName(pkg)}
+			byDir[pkg.DstDir] = p
+		}
+		p.sources = append(p.sources, pkg.SrcImportPath)
+	}
+
+	for dir, p := range byDir {
+		dst := filepath.Join(dir, provenanceFileName)
+		for src, other := range w.GoFiles {
+			if other == dst {
+				return fmt.Errorf("cannot write provenance to %q: it would overwrite %q", dst, src)
+			}
+		}
+		if !force && fileExists(dst) && !managed[dst] && !isProvenanceFile(dst) {
+			return fmt.Errorf("cannot write provenance to %q: it would overwrite an unmanaged file (use -force to proceed anyway)", dst)
+		}
+
+		buf := new(bytes.Buffer)
+		buf.WriteString(provenanceHeader)
+		fmt.Fprintln(buf, "// This package was transplanted by mirage from:")
+		fmt.Fprintln(buf, "//")
+		for _, src := range p.sources {
+			fmt.Fprintf(buf, "//\t%s\n", src)
+		}
+		if commit != "" {
+			fmt.Fprintln(buf, "//")
+			fmt.Fprintf(buf, "// Source commit: %s\n", commit)
+		}
+		fmt.Fprintf(buf, "package %s\n", p.name)
+		w.GeneratedFiles[dst] = buf.Bytes()
+	}
+	return nil
+}
+
+// isProvenanceFile returns true if the file at path begins with the
+// provenance header.
+func isProvenanceFile(path string) bool {
+	data, err := os.ReadFile(path)
+	return err == nil && bytes.HasPrefix(data, []byte(provenanceHeader))
+}
+
+// sourceCommit returns the git commit checked out in the source module
+// directory, or an empty string if it cannot be determined.
+func sourceCommit(dir string) string {
+	out, err := execInDirOutput(dir, "git", "rev-parse", "HEAD")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(out)
+}
+
+func writeGeneratedFile(dstPath string, data []byte) error {
+	if err := ensureDir(filepath.Dir(dstPath)); err != nil {
+		return fmt.Errorf("failed to ensure destination directory exists: %w", err)
+	}
+	if err := writeFile(dstPath, data); err != nil {
+		return fmt.Errorf("failed to write generated file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProvenanceRefusesUnmanagedFile(t *testing.T) {
+	srcDir := newModule(t, "example.com/old", map[string]string{
+		"foo.go": "package foo\n\nfunc Foo() int { return 1 }\n",
+	})
+	handWritten := "package foo\n\n// Hand-written.\n"
+	dstDir := newModule(t, "example.com/new", map[string]string{
+		provenanceFileName: handWritten,
+	})
+
+	opts := testOptions()
+	opts.Merge = true
+	opts.Provenance = true
+	_, err := transplantForTest(t, dstDir, srcDir, opts)
+	if err == nil || !strings.Contains(err.Error(), "it would overwrite an unmanaged file") {
+		t.Fatalf("expected the unmanaged file to be refused, got %v", err)
+	}
+	if got := readFile(t, filepath.Join(dstDir, provenanceFileName)); got != handWritten {
+		t.Errorf("expected the unmanaged file to be left alone, got:\n%s", got)
+	}
+}
+
+func TestProvenanceOverwritesEarlierProvenance(t *testing.T) {
+	srcDir := newModule(t, "example.com/old", map[string]string{
+		"foo.go": "package foo\n\nfunc Foo() int { return 1 }\n",
+	})
+
+	for _, mirror := range []bool{false, true} {
+		dstDir := newModule(t, "example.com/new", nil)
+		for i := 0; i < 2; i++ {
+			opts := testOptions()
+			opts.Provenance = true
+			if mirror {
+				opts.Mirror = true
+				opts.Manifest = defaultManifestName
+			}
+			if _, err := transplantForTest(t, dstDir, srcDir, opts); err != nil {
+				t.Fatalf("mirror=%t, run %d: %v", mirror, i+1, err)
+			}
+		}
+		if got := readFile(t, filepath.Join(dstDir, provenanceFileName)); !strings.Contains(got, "example.com/old") {
+			t.Errorf("mirror=%t: expected the provenance file to name the source:\n%s", mirror, got)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"strings"
+)
+
+// parseRenames parses the package clause renames given via -rename-pkg into a
+// map from source import path to new package name. Each rename has the form
+// IMPORTPATH=NEWNAME.
+func parseRenames(renames []string) (map[string]string, error) {
+	parsed := make(map[string]string)
+	for _, rename := range renames {
+		importPath, name, ok := strings.Cut(rename, "=")
+		importPath, name = strings.TrimSpace(importPath), strings.TrimSpace(name)
+		if !ok || importPath == "" || name == "" {
+			return nil, fmt.Errorf("invalid package rename %q: expected IMPORTPATH=NEWNAME", rename)
+		}
+		if !token.IsIdentifier(name) || name == "_" || name == "main" {
+			return nil, fmt.Errorf("invalid package rename %q: %q is not a valid package name", rename, name)
+		}
+		if existing, ok := parsed[importPath]; ok && existing != name {
+			return nil, fmt.Errorf("conflicting package renames for %q: %q and %q", importPath, existing, name)
+		}
+		parsed[importPath] = name
+	}
+	return parsed, nil
+}
+
+// checkRenames ensures each package rename names a transplanted package whose
+// files are not flattened into another package.
+func (w *Work) checkRenames() error {
+	for _, importPath := range sortedKeys(w.PackageRenames) {
+		pkg := w.findPackage(importPath)
+		switch {
+		case pkg == nil:
+			return fmt.Errorf("cannot rename package %q: it is not transplanted", importPath)
+		case pkg.Name == "main":
+			return fmt.Errorf("cannot rename package %q: it is a main package", importPath)
+		case w.FlattenedPackages[importPath] != "":
+			return fmt.Errorf("cannot rename package %q: it is flattened into %q", importPath, w.FlattenPath)
+		}
+	}
+	return nil
+}
+
+// findPackage returns the transplanted package with the given source import
+// path, or nil if there is none.
+func (w *Work) findPackage(srcImportPath string) *WorkPackage {
+	for _, pkg := range w.Packages {
+		if pkg.SrcImportPath == srcImportPath {
+			return pkg
+		}
+	}
+	return nil
+}
+
+// renamePackages rewrites the source of a Go file for the package renames,
+// which map source import paths to their old and new package names. If
+// ownName is set the file belongs to a renamed package and its package clause
+// is changed to ownName. References qualified by the name of an imported
+// renamed package (unless the import gives its own name) are changed to the
+// new name.
+func renamePackages(filename string, data []byte, renames map[string][2]string, ownName string) ([]byte, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, filename, data, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	offset := func(pos token.Pos) int {
+		return fset.Position(pos).Offset
+	}
+
+	var edits []textEdit
+	if ownName != "" {
+		name := ownName
+		if strings.HasSuffix(file.Name.Name, "_test") {
+			name += "_test"
+		}
+		edits = append(edits, textEdit{Start: offset(file.Name.Pos()), End: offset(file.Name.End()), Text: name})
+	}
+
+	newNames := make(map[string]string)
+	for _, spec := range file.Imports {
+		importPath, _ := strconv.Unquote(spec.Path.Value)
+		if names, ok := renames[importPath]; ok && spec.Name == nil {
+			newNames[names[0]] = names[1]
+		}
+	}
+	if len(newNames) > 0 {
+		ast.Inspect(file, func(n ast.Node) bool {
+			sel, ok := n.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			ident, ok := sel.X.(*ast.Ident)
+			if !ok || ident.Obj != nil {
+				return true
+			}
+			if newName, ok := newNames[ident.Name]; ok {
+				edits = append(edits, textEdit{Start: offset(ident.Pos()), End: offset(ident.End()), Text: newName})
+			}
+			return false
+		})
+	}
+
+	if len(edits) == 0 {
+		return data, nil
+	}
+	return applyEdits(data, edits), nil
+}
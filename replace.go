@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseReplaces validates the replace directives given via -add-replace. Each
+// has the form OLD[@VERSION]=NEW[@VERSION], as accepted by go mod edit
+// -replace; NEW is either a module path, which requires a version, or a local
+// directory (starting with ./, ../, or /), which must not have one.
+func parseReplaces(replaces []string) ([]string, error) {
+	var parsed []string
+	for _, replace := range replaces {
+		from, to, ok := strings.Cut(replace, "=")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid replace %q: expected OLD[@VERSION]=NEW[@VERSION]", replace)
+		}
+		if oldPath, oldVersion, ok := strings.Cut(from, "@"); ok && (oldPath == "" || oldVersion == "") {
+			return nil, fmt.Errorf("invalid replace %q: malformed old module %q", replace, from)
+		}
+		isDir := strings.HasPrefix(to, "./") || strings.HasPrefix(to, "../") || strings.HasPrefix(to, "/")
+		newPath, newVersion, hasVersion := strings.Cut(to, "@")
+		switch {
+		case isDir && hasVersion:
+			return nil, fmt.Errorf("invalid replace %q: a local directory replacement cannot have a version", replace)
+		case !isDir && (!hasVersion || newPath == "" || newVersion == ""):
+			return nil, fmt.Errorf("invalid replace %q: a module replacement needs a version (use ./ or ../ for a local directory)", replace)
+		}
+		parsed = append(parsed, from+"="+to)
+	}
+	return parsed, nil
+}
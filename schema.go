@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/zeebo/errs"
+)
+
+// printSchema returns the JSON Schema for the named format: "manifest" for
+// the manifest written after each run, or "config" for Options as decoded
+// from JSON.
+func printSchema(name string) ([]byte, error) {
+	var schema map[string]any
+	switch name {
+	case "manifest":
+		schema = jsonSchema(reflect.TypeOf(Manifest{}))
+		schema["title"] = "mirage manifest"
+	case "config":
+		schema = jsonSchema(reflect.TypeOf(Options{}))
+		schema["title"] = "mirage options"
+	default:
+		return nil, fmt.Errorf("unknown schema %q; expected manifest or config", name)
+	}
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+
+	data, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	return append(data, '\n'), nil
+}
+
+// jsonSchema describes how values of the type are encoded by encoding/json.
+// Fields that cannot be encoded (e.g. funcs) are left out.
+func jsonSchema(t reflect.Type) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return jsonSchema(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": jsonSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": jsonSchema(t.Elem())}
+	case reflect.Struct:
+		properties := make(map[string]any)
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() || !encodable(field.Type) {
+				continue
+			}
+			name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+			switch {
+			case name == "-":
+				continue
+			case name == "":
+				// encoding/json matches names case-insensitively, so
+				// untagged fields are described in the same camel case as
+				// tagged ones.
+				name = lowerCamel(field.Name)
+			case !strings.Contains(opts, "omitempty"):
+				required = append(required, name)
+			}
+			properties[name] = jsonSchema(field.Type)
+		}
+		schema := map[string]any{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	default:
+		return map[string]any{}
+	}
+}
+
+// lowerCamel lower cases the leading initialism or word of a Go identifier,
+// e.g. EOL becomes eol and SrcPkg becomes srcPkg.
+func lowerCamel(name string) string {
+	runes := []rune(name)
+	for i := range runes {
+		if !unicode.IsUpper(runes[i]) || (i > 0 && i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+			break
+		}
+		runes[i] = unicode.ToLower(runes[i])
+	}
+	return string(runes)
+}
+
+// encodable returns true if encoding/json can encode values of the type.
+func encodable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Func, reflect.Chan, reflect.Complex64, reflect.Complex128, reflect.UnsafePointer:
+		return false
+	case reflect.Pointer, reflect.Slice, reflect.Array, reflect.Map:
+		return encodable(t.Elem())
+	default:
+		return true
+	}
+}
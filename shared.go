@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// readSharedManifests reads the manifests of the other transplants sharing
+// the destination, given via -shared-manifest relative to the destination
+// directory (unless absolute). It returns the destination paths they manage,
+// mapped to their manifest entries.
+func readSharedManifests(dstDir string, paths []string) (map[string]ManifestFile, error) {
+	shared := make(map[string]ManifestFile)
+	for _, path := range paths {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dstDir, path)
+		}
+		manifest, err := readManifest(path)
+		switch {
+		case err != nil:
+			return nil, fmt.Errorf("failed to read shared manifest: %w", err)
+		case manifest == nil:
+			return nil, fmt.Errorf("shared manifest %q does not exist", path)
+		}
+		for _, file := range manifest.Files {
+			shared[filepath.Clean(filepath.Join(dstDir, filepath.FromSlash(file.Dst)))] = file
+		}
+	}
+	return shared, nil
+}
+
+// reuseSharedFiles drops the planned copies whose destination is already
+// managed by another transplant with the same content, so that transplants
+// sharing internal dependencies can be composed in one destination. A shared
+// file is reused if its source content is the same as the other transplant's
+// and it has not been modified since. Any other overlap is an error.
+func (w *Work) reuseSharedFiles(shared map[string]ManifestFile) error {
+	var conflicts []string
+	for _, files := range []map[string]string{w.GoFiles, w.OtherFiles} {
+		for _, src := range sortedKeys(files) {
+			dst := files[src]
+			file, ok := shared[filepath.Clean(dst)]
+			if !ok {
+				continue
+			}
+
+			srcSum, err := hashFile(src)
+			if err != nil {
+				return fmt.Errorf("failed to hash %q: %w", src, err)
+			}
+			dstSum, err := hashFile(dst)
+			if err != nil {
+				dstSum = ""
+			}
+			if file.SrcSHA256 != srcSum || file.SHA256 != dstSum {
+				conflicts = append(conflicts, fmt.Sprintf("%s (from %s)", dst, src))
+				continue
+			}
+
+			logger.Debug("Reusing file shared with another transplant", "src", src, "dst", dst)
+			delete(files, src)
+			w.SharedFiles = append(w.SharedFiles, dst)
+		}
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("destination files managed by another transplant would be overwritten with different content:\n  %s", strings.Join(conflicts, "\n  "))
+	}
+	return nil
+}
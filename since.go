@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sinceUnchanged returns the destination paths of the planned files whose
+// source has not changed since the git revision, so that they can be
+// skipped, and removes the destination files of sources deleted since then.
+// The prior manifest maps deleted sources to their destinations. If the
+// rewriting inputs have changed since the prior run, every file is rewritten.
+func sinceUnchanged(work *Work, manifestPath, fingerprint, rev string) (map[string]bool, error) {
+	if manifestPath == "" {
+		return nil, errors.New("-since requires -manifest")
+	}
+	prior, err := readManifest(manifestPath)
+	switch {
+	case err != nil:
+		return nil, fmt.Errorf("failed to read prior manifest: %w", err)
+	case prior == nil:
+		return nil, errors.New("-since requires the manifest of a prior full run")
+	case prior.Fingerprint != fingerprint:
+		logger.Info("Rewriting inputs changed since the prior run; copying every file")
+		return nil, nil
+	}
+
+	changed, err := gitPaths(work.SrcModuleDir, "diff", "--name-only", "--no-renames", "--relative", rev, "--")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list source files changed since %q: %w", rev, err)
+	}
+	untracked, err := gitPaths(work.SrcModuleDir, "ls-files", "--others", "--exclude-standard")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list untracked source files: %w", err)
+	}
+	for path := range untracked {
+		changed[path] = true
+	}
+
+	unchanged := make(map[string]bool)
+	planned := make(map[string]bool)
+	for _, files := range []map[string]string{work.GoFiles, work.OtherFiles} {
+		for src, dst := range files {
+			planned[filepath.Clean(dst)] = true
+			rel, err := relPath(work.SrcModuleDir, src)
+			if err != nil {
+				return nil, err
+			}
+			if !changed[rel] && fileExists(dst) {
+				unchanged[dst] = true
+			}
+		}
+	}
+
+	for _, file := range prior.Files {
+		if file.Src == "" || !changed[file.Src] || fileExists(filepath.Join(work.SrcModuleDir, filepath.FromSlash(file.Src))) {
+			continue
+		}
+		dst := filepath.Join(work.DstDir, filepath.FromSlash(file.Dst))
+		if planned[filepath.Clean(dst)] {
+			continue
+		}
+		logger.Info("Removing file deleted from the source", "src", file.Src, "dst", dst)
+		if err := os.Remove(dst); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("failed to remove %q: %w", dst, err)
+		}
+		work.removed = append(work.removed, dst)
+	}
+
+	logger.Info("Skipping files unchanged since revision", "rev", rev, "files", len(unchanged))
+	return unchanged, nil
+}
+
+// gitPaths runs git in dir and returns the set of paths it prints, one per
+// line, in slash form.
+func gitPaths(dir string, args ...string) (map[string]bool, error) {
+	out, err := execInDirOutput(dir, "git", args...)
+	if err != nil {
+		return nil, err
+	}
+	paths := make(map[string]bool)
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			paths[line] = true
+		}
+	}
+	return paths, nil
+}
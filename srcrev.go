@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zeebo/errs"
+)
+
+// checkoutSrcRev checks out the given revision of the git repository holding
+// srcDir into a temporary worktree. It returns the directory corresponding to
+// srcDir within the worktree and a function that removes the worktree.
+func checkoutSrcRev(srcDir, rev string) (_ string, cleanup func(), err error) {
+	cleanup = func() {}
+
+	absSrcDir, err := filepath.Abs(srcDir)
+	if err != nil {
+		return "", cleanup, errs.Wrap(err)
+	}
+	absSrcDir, err = filepath.EvalSymlinks(absSrcDir)
+	if err != nil {
+		return "", cleanup, errs.Wrap(err)
+	}
+	out, err := execInDirOutput(absSrcDir, "git", "rev-parse", "--show-toplevel")
+	if err != nil {
+		return "", cleanup, fmt.Errorf("source is not in a git repository: %w", err)
+	}
+	repoDir := strings.TrimSpace(out)
+	rel, err := filepath.Rel(repoDir, absSrcDir)
+	if err != nil {
+		return "", cleanup, errs.Wrap(err)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "mirage-rev-")
+	if err != nil {
+		return "", cleanup, errs.Wrap(err)
+	}
+	worktree := filepath.Join(tmpDir, "src")
+	cleanup = func() {
+		if err := execInDir(repoDir, "git", "worktree", "remove", "--force", worktree); err != nil {
+			logger.Warn("Failed to remove source worktree", "dir", worktree, "err", err)
+		}
+		_ = os.RemoveAll(tmpDir)
+	}
+
+	if err := execInDir(repoDir, "git", "worktree", "add", "--detach", worktree, rev); err != nil {
+		_ = os.RemoveAll(tmpDir)
+		return "", func() {}, fmt.Errorf("failed to check out source revision %q: %w", rev, err)
+	}
+	return filepath.Join(worktree, rel), cleanup, nil
+}
+
+// diffRevs transplants the source at -src-rev and at -diff-rev into two
+// temporary destinations and prints a unified diff between them. DSTDIR is
+// only consulted for the destination module name and is never written.
+func diffRevs(dstDir, srcDir string, opts *Options) error {
+	if opts.SrcRev == "" {
+		return errors.New("-diff-rev requires -src-rev")
+	}
+
+	dstModule := opts.DstModule
+	if dstModule == "" {
+		var err error
+		dstModule, err = getModulePath(dstDir)
+		if err != nil {
+			return fmt.Errorf("no destination module available; use --dst-module or create go.mod at the destination: %w", err)
+		}
+	}
+
+	tmpDir, err := os.MkdirTemp("", "mirage-diff-")
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	// The transplants are named a and b so the diff reads like any other.
+	for _, side := range []struct{ name, rev string }{{"a", opts.SrcRev}, {"b", opts.DiffRev}} {
+		logger.Info("Transplanting source revision...", "rev", side.rev)
+		if err := transplantRev(filepath.Join(tmpDir, side.name), srcDir, side.rev, dstModule, opts); err != nil {
+			return err
+		}
+	}
+
+	return diffDirs(tmpDir, "a", "b", os.Stdout)
+}
+
+// transplantRev transplants the source at the given revision into a fresh
+// destination directory for the destination module.
+func transplantRev(dstDir, srcDir, rev, dstModule string, opts *Options) error {
+	revSrcDir, cleanup, err := checkoutSrcRev(srcDir, rev)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if err := ensureDir(dstDir); err != nil {
+		return errs.Wrap(err)
+	}
+	if err := writeFile(filepath.Join(dstDir, "go.mod"), []byte("module "+dstModule+"\n")); err != nil {
+		return errs.Wrap(err)
+	}
+
+	// The temporary destinations are always written from scratch and carry
+	// no manifest, which would otherwise show up in the diff.
+	revOpts := *opts
+	revOpts.DstModule = dstModule
+	revOpts.Manifest = ""
+	revOpts.Mirror = false
+	revOpts.PruneOther = false
+	revOpts.Merge = false
+	revOpts.Patch = ""
+
+	work, err := getWork(dstDir, revSrcDir, &revOpts)
+	if err != nil {
+		return err
+	}
+	return doWork(work, &revOpts)
+}
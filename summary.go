@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"time"
+
+	"github.com/zeebo/errs"
+)
+
+// Summary is a compact report of a transplant, written with -summary-json
+// for dashboards that do not need the full manifest.
+type Summary struct {
+	MirageVersion   string         `json:"mirageVersion"`
+	Timestamp       time.Time      `json:"timestamp"`
+	Elapsed         string         `json:"elapsed"`
+	SrcImportPath   string         `json:"srcImportPath"`
+	SrcCommit       string         `json:"srcCommit,omitempty"`
+	DstModule       string         `json:"dstModule"`
+	Files           map[string]int `json:"files"`
+	RequiresAdded   []string       `json:"requiresAdded"`
+	RequiresUpdated []string       `json:"requiresUpdated"`
+	LOC             *LOC           `json:"loc,omitempty"`
+}
+
+// buildSummary summarizes the work. priorRequires holds the requirements of
+// the destination go.mod before the run, so that the external requirements
+// added or updated by the transplant can be reported.
+func buildSummary(work *Work, priorRequires map[string]string, elapsed time.Duration) (*Summary, error) {
+	requires, err := getRequires(work.DstDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read destination requirements: %w", err)
+	}
+	added, updated := requireChanges(priorRequires, requires)
+
+	version := "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		version = info.Main.Version
+	}
+
+	return &Summary{
+		MirageVersion: version,
+		Timestamp:     time.Now().UTC().Truncate(time.Second),
+		Elapsed:       elapsed.Round(time.Millisecond).String(),
+		SrcImportPath: work.SrcImportPath,
+		SrcCommit:     sourceCommit(work.SrcModuleDir),
+		DstModule:     work.DstModule,
+		Files: map[string]int{
+			fileKindGo:        len(work.GoFiles),
+			fileKindOther:     len(work.OtherFiles),
+			fileKindGenerated: len(work.GeneratedFiles),
+		},
+		RequiresAdded:   added,
+		RequiresUpdated: updated,
+	}, nil
+}
+
+// requireChanges returns the requirements added since prior, as
+// "path@version", and those whose version changed, as "path@from => to".
+func requireChanges(prior, requires map[string]string) (added, updated []string) {
+	added, updated = []string{}, []string{}
+	for path, version := range requires {
+		switch from, ok := prior[path]; {
+		case !ok:
+			added = append(added, path+"@"+version)
+		case from != version:
+			updated = append(updated, path+"@"+from+" => "+version)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(updated)
+	return added, updated
+}
+
+// writeSummary writes the summary, or with -fan-out the list of summaries
+// for each destination, to path.
+func writeSummary(path string, summary any) error {
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write summary: %w", err)
+	}
+	return nil
+}
+
+// getRequires returns the requirements of the go.mod in dir as a map from
+// module path to version. A missing go.mod has no requirements.
+func getRequires(dir string) (map[string]string, error) {
+	requires := make(map[string]string)
+	if !fileExists(filepath.Join(dir, "go.mod")) {
+		return requires, nil
+	}
+	info := &struct {
+		Require []struct {
+			Path    string
+			Version string
+		}
+	}{}
+	if err := execInDirAndParseJSON(dir, info, goBin, "mod", "edit", "-json"); err != nil {
+		return nil, err
+	}
+	for _, require := range info.Require {
+		requires[require.Path] = require.Version
+	}
+	return requires, nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRequireChangesSeparatesAddedFromUpdated(t *testing.T) {
+	prior := map[string]string{
+		"example.com/same":    "v1.0.0",
+		"example.com/bumped":  "v1.0.0",
+		"example.com/dropped": "v1.0.0",
+	}
+	requires := map[string]string{
+		"example.com/same":   "v1.0.0",
+		"example.com/bumped": "v1.2.0",
+		"example.com/new":    "v0.1.0",
+	}
+	added, updated := requireChanges(prior, requires)
+	if want := []string{"example.com/new@v0.1.0"}; !reflect.DeepEqual(added, want) {
+		t.Errorf("got added %v, want %v", added, want)
+	}
+	if want := []string{"example.com/bumped@v1.0.0 => v1.2.0"}; !reflect.DeepEqual(updated, want) {
+		t.Errorf("got updated %v, want %v", updated, want)
+	}
+}
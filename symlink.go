@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/zeebo/errs"
+)
+
+// isSymlink returns true if path is a symbolic link.
+func isSymlink(path string) bool {
+	info, err := os.Lstat(path)
+	return err == nil && info.Mode()&fs.ModeSymlink != 0
+}
+
+// copySymlink recreates the symlink at src as a symlink at dst. If the link
+// points at a file that is also copied, the new link points at that file's
+// destination. Otherwise the target is kept as a relative path. Either way
+// the link must resolve within the destination directory.
+func (w *Work) copySymlink(src, dst string) error {
+	target, err := os.Readlink(src)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	absTarget := target
+	if !filepath.IsAbs(absTarget) {
+		absTarget = filepath.Join(filepath.Dir(src), target)
+	}
+	if absTarget, err = filepath.Abs(absTarget); err != nil {
+		return errs.Wrap(err)
+	}
+
+	newTarget := target
+	if copiedDst, ok := w.copiedDst(absTarget); ok {
+		newTarget = copiedDst
+	}
+	if filepath.IsAbs(newTarget) || newTarget != target {
+		if newTarget, err = filepath.Rel(filepath.Dir(dst), newTarget); err != nil {
+			return errs.Wrap(err)
+		}
+	}
+	if rel, err := filepath.Rel(w.DstDir, filepath.Join(filepath.Dir(dst), newTarget)); err != nil || !filepath.IsLocal(rel) {
+		return fmt.Errorf("cannot preserve symlink %q: its target %q is outside of the destination", src, target)
+	}
+
+	if err := ensureDir(filepath.Dir(dst)); err != nil {
+		return fmt.Errorf("failed to ensure destination directory exists: %w", err)
+	}
+	if err := os.Remove(dst); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return errs.Wrap(err)
+	}
+	if err := os.Symlink(newTarget, dst); err != nil {
+		return fmt.Errorf("failed to create symlink: %w", err)
+	}
+	return nil
+}
+
+// copiedDst returns the destination of the source file at the absolute path,
+// if it is copied.
+func (w *Work) copiedDst(absSrc string) (string, bool) {
+	for _, files := range []map[string]string{w.GoFiles, w.OtherFiles} {
+		for src, dst := range files {
+			if abs, err := filepath.Abs(src); err == nil && abs == absSrc {
+				return dst, true
+			}
+		}
+	}
+	return "", false
+}
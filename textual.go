@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"go/parser"
+	"go/token"
+	"os"
+	"strconv"
+
+	"github.com/zeebo/errs"
+)
+
+// textualMatch is an occurrence of a quoted source import path outside of an
+// import declaration.
+type textualMatch struct {
+	Line int
+	Path string
+}
+
+// findTextualMatches reports each place in the Go file at path where one of
+// the quoted source import paths in replacements appears outside of an import
+// declaration, e.g. in a string literal or comment. These are rewritten by the
+// textual replacement just like imports are, which is likely not intended.
+func findTextualMatches(path string, replacements []string) ([]textualMatch, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, path, data, parser.ImportsOnly|parser.SkipObjectResolution)
+	if err != nil {
+		return nil, errs.Wrap(err)
+	}
+	tf := fset.File(file.Pos())
+
+	imports := make(map[int]bool)
+	for _, spec := range file.Imports {
+		imports[tf.Offset(spec.Path.Pos())] = true
+	}
+
+	var matches []textualMatch
+	for i := 0; i < len(replacements); i += 2 {
+		quoted := []byte(replacements[i])
+		for offset := 0; ; {
+			n := bytes.Index(data[offset:], quoted)
+			if n < 0 {
+				break
+			}
+			offset += n
+			if !imports[offset] {
+				srcPath, _ := strconv.Unquote(replacements[i])
+				matches = append(matches, textualMatch{
+					Line: bytes.Count(data[:offset], []byte("\n")) + 1,
+					Path: srcPath,
+				})
+			}
+			offset += len(quoted)
+		}
+	}
+	return matches, nil
+}
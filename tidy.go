@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	tidyErrorsFail     = "fail"
+	tidyErrorsContinue = "continue"
+)
+
+const (
+	tidyOrderBefore = "before"
+	tidyOrderAfter  = "after"
+)
+
+// tidyAndVerify runs go mod tidy (unless in vendor mode) and, with -verify,
+// builds the destination, in the order given by -tidy-order. Tidying first
+// (the default) lets the build see the requirements the transplant needs;
+// building first reports missing imports and other build errors before tidy
+// adds or prunes anything, at the cost of build errors for requirements that
+// tidy would have added.
+func tidyAndVerify(work *Work, opts *Options) error {
+	steps := []func() error{
+		func() error {
+			if opts.VendorMode {
+				return nil
+			}
+			logger.Info("Tidying...")
+			return tidy(work, opts)
+		},
+		func() error {
+			if !opts.Verify {
+				return nil
+			}
+			logger.Info("Verifying...")
+			return verify(work)
+		},
+	}
+	if opts.TidyOrder == tidyOrderAfter {
+		steps[0], steps[1] = steps[1], steps[0]
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verify builds every package beneath the destination.
+func verify(work *Work) error {
+	output, err := execInDirCombinedOutput(work.DstDir, goBin, "build", "./...")
+	if err != nil {
+		return fmt.Errorf("failed to build the destination: %w: %s", err, output)
+	}
+	return nil
+}
+
+// resetGoSum removes the destination go.sum once go.mod has been replaced by
+// the source's, so that tidy regenerates it for the transplant rather than
+// keeping sums left over from whatever the destination required before. The
+// source go.sum is never copied as is. With -no-tidy-download, tidy cannot
+// fetch the sums it needs, so the source go.sum (which holds the sums for the
+// requirements just copied) is used as the starting point instead, and tidy
+// prunes it.
+func resetGoSum(work *Work, opts *Options) error {
+	dstGoSum := filepath.Join(work.DstDir, "go.sum")
+	if err := os.Remove(dstGoSum); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove destination go.sum: %w", err)
+	}
+	if !opts.NoTidyDownload {
+		return nil
+	}
+	srcGoSum := filepath.Join(filepath.Dir(work.SrcGoMod), "go.sum")
+	if !fileExists(srcGoSum) {
+		return nil
+	}
+	if err := copyOtherFile(srcGoSum, dstGoSum); err != nil {
+		return fmt.Errorf("failed to seed destination go.sum: %w", err)
+	}
+	return nil
+}
+
+// tidy runs go mod tidy in the destination. With -tidy-errors=continue the
+// errors tidy reports are warnings rather than failing the run. With
+// -no-tidy-download tidy may not download modules, so it fails if the
+// transplant needs a module that is not already in the module cache.
+func tidy(work *Work, opts *Options) error {
+	args := []string{"mod", "tidy"}
+	if opts.TidyErrors == tidyErrorsContinue {
+		args = append(args, "-e")
+	}
+	cmd := exec.Command(goBin, args...)
+	cmd.Dir = work.DstDir
+	if opts.NoTidyDownload {
+		cmd.Env = append(os.Environ(), "GOPROXY=off", "GOFLAGS="+strings.TrimSpace(os.Getenv("GOFLAGS")+" -mod=mod"))
+	}
+
+	output, err := runCombinedOutput(cmd)
+	switch {
+	case err != nil && opts.NoTidyDownload:
+		return fmt.Errorf("failed to tidy without downloading (is a required module missing from the module cache?): %w: %s", err, output)
+	case err != nil:
+		return fmt.Errorf("failed to tidy: %w: %s", err, output)
+	}
+
+	if opts.TidyErrors == tidyErrorsContinue {
+		for _, tidyErr := range parseTidyErrors(output) {
+			if err := warn(opts.Strict, "go mod tidy reported an error", "error", tidyErr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parseTidyErrors returns the errors in the output of go mod tidy -e, joining
+// the indented continuation lines of each error and leaving out progress
+// messages.
+func parseTidyErrors(output string) []string {
+	var tidyErrs []string
+	for _, line := range strings.Split(output, "\n") {
+		switch {
+		case strings.TrimSpace(line) == "":
+		case strings.HasPrefix(line, "go: downloading "), strings.HasPrefix(line, "go: finding "), strings.HasPrefix(line, "go: found "):
+		case (line[0] == '\t' || line[0] == ' ') && len(tidyErrs) > 0:
+			tidyErrs[len(tidyErrs)-1] += " " + strings.TrimSpace(line)
+		default:
+			tidyErrs = append(tidyErrs, strings.TrimSpace(line))
+		}
+	}
+	return tidyErrs
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTransplantRegeneratesGoSum(t *testing.T) {
+	proxyDir := t.TempDir()
+	writeModuleProxy(t, proxyDir, "example.com/dep", "v1.0.0", map[string]string{
+		"dep.go": "package dep\n\nvar Dep = 1\n",
+	})
+	t.Setenv("GOPROXY", "file://"+filepath.ToSlash(proxyDir))
+	t.Setenv("GOSUMDB", "off")
+	t.Setenv("GOMODCACHE", t.TempDir())
+	t.Setenv("GOFLAGS", "-modcacherw")
+
+	srcDir := newModule(t, "example.com/old", map[string]string{
+		"foo.go": "package foo\n\nimport \"example.com/dep\"\n\nvar Foo = dep.Dep\n",
+	})
+	writeFiles(t, srcDir, map[string]string{
+		"go.mod": "module example.com/old\n\ngo 1.21\n\nrequire example.com/dep v1.0.0\n",
+	})
+	if output, err := execInDirCombinedOutput(srcDir, goBin, "mod", "download", "example.com/dep"); err != nil {
+		t.Fatalf("failed to download the dependency: %v\n%s", err, output)
+	}
+	dstDir := newModule(t, "example.com/new", nil)
+	writeFiles(t, dstDir, map[string]string{
+		"go.sum": "example.com/dep v1.0.0 h1:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=\nexample.com/unrelated v1.0.0 h1:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=\n",
+	})
+
+	opts := testOptions()
+	if _, err := transplantForTest(t, dstDir, srcDir, opts); err != nil {
+		t.Fatal(err)
+	}
+	goSum := readFile(t, filepath.Join(dstDir, "go.sum"))
+	if strings.Contains(goSum, "AAAAAAAA") {
+		t.Errorf("expected the stale sums to be gone from the destination go.sum:\n%s", goSum)
+	}
+	for _, want := range []string{"example.com/dep v1.0.0 h1:", "example.com/dep v1.0.0/go.mod h1:"} {
+		if !strings.Contains(goSum, want) {
+			t.Errorf("expected the destination go.sum to contain %q:\n%s", want, goSum)
+		}
+	}
+	if output, err := execInDirCombinedOutput(dstDir, goBin, "mod", "verify"); err != nil {
+		t.Fatalf("destination go.sum does not verify: %v\n%s", err, output)
+	}
+	buildModule(t, dstDir)
+}
+
+// writeModuleProxy writes a version of a module to dir in the layout of a
+// file:// GOPROXY.
+func writeModuleProxy(t *testing.T, dir, modulePath, version string, files map[string]string) {
+	t.Helper()
+	versionDir := filepath.Join(dir, filepath.FromSlash(modulePath), "@v")
+	goMod := "module " + modulePath + "\n\ngo 1.21\n"
+	writeFiles(t, versionDir, map[string]string{
+		"list":            version + "\n",
+		version + ".info": `{"Version": "` + version + `"}`,
+		version + ".mod":  goMod,
+	})
+
+	f, err := os.Create(filepath.Join(versionDir, version+".zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	archive := zip.NewWriter(f)
+	files["go.mod"] = goMod
+	for name, content := range files {
+		w, err := archive.Create(modulePath + "@" + version + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Toolchain records the versions of the go and goimports commands used for
+// a transplant. GoimportsVersion is the version of the module goimports was
+// built from, and is empty if it could not be determined (e.g. for a
+// goimports that was not built with module support).
+type Toolchain struct {
+	GoVersion        string `json:"goVersion"`
+	GoimportsVersion string `json:"goimportsVersion,omitempty"`
+}
+
+// getToolchain captures the versions of go and goimports and, with
+// -require-go, checks the go version is the one required.
+func getToolchain(opts *Options) (*Toolchain, error) {
+	goVersion, err := execInDirOutput(".", goBin, "env", "GOVERSION")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get go version: %w", err)
+	}
+	toolchain := &Toolchain{
+		GoVersion:        strings.TrimSpace(goVersion),
+		GoimportsVersion: goimportsVersion(),
+	}
+	logger.Debug("Captured toolchain versions", "go", toolchain.GoVersion, "goimports", toolchain.GoimportsVersion)
+
+	if opts.RequireGo != "" {
+		required := "go" + strings.TrimPrefix(opts.RequireGo, "go")
+		if toolchain.GoVersion != required {
+			if err := warn(opts.Strict, "Go version differs from -require-go", "required", required, "actual", toolchain.GoVersion); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return toolchain, nil
+}
+
+// goimportsVersion returns the version of the module the goimports binary
+// was built from, according to go version -m, or an empty string if it
+// cannot be determined.
+func goimportsVersion() string {
+	path, err := exec.LookPath("goimports")
+	if err != nil {
+		return ""
+	}
+	output, err := execInDirOutput(".", goBin, "version", "-m", path)
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(output, "\n") {
+		// The main module line is "\tmod\tPATH\tVERSION\tSUM".
+		if fields := strings.Fields(line); len(fields) >= 3 && fields[0] == "mod" {
+			return fields[2]
+		}
+	}
+	return ""
+}
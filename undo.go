@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zeebo/errs"
+)
+
+// undo removes the files recorded in the manifest at manifestPath from
+// dstDir, along with any directories left empty, and finally the manifest
+// itself. go.mod is left as-is. Files that were modified since the transplant
+// are not removed (and nothing is) unless force is set.
+func undo(manifestPath, dstDir string, force bool) error {
+	manifest, err := readManifest(manifestPath)
+	switch {
+	case err != nil:
+		return fmt.Errorf("failed to read manifest: %w", err)
+	case manifest == nil:
+		return fmt.Errorf("manifest %q does not exist", manifestPath)
+	}
+
+	var paths []string
+	var modified []string
+	for _, file := range manifest.Files {
+		if !filepath.IsLocal(filepath.FromSlash(file.Dst)) {
+			return fmt.Errorf("manifest entry %q is outside of the destination", file.Dst)
+		}
+		path := filepath.Join(dstDir, filepath.FromSlash(file.Dst))
+		sum, err := hashFile(path)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			logger.Debug("Managed file already removed", "dst", path)
+			continue
+		case err != nil:
+			return fmt.Errorf("failed to hash %q: %w", path, err)
+		case sum != file.SHA256:
+			modified = append(modified, path)
+		}
+		paths = append(paths, path)
+	}
+	if len(modified) > 0 && !force {
+		return fmt.Errorf("refusing to undo; files were modified since the transplant (use -force to remove them anyway):\n  %s", strings.Join(modified, "\n  "))
+	}
+
+	logger.Info("Removing managed files...")
+	for _, path := range paths {
+		logger.Debug("Removing managed file", "dst", path)
+		if err := os.Remove(path); err != nil {
+			return errs.Wrap(err)
+		}
+		if err := pruneEmptyParents(dstDir, filepath.Dir(path)); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Remove(manifestPath); err != nil {
+		return fmt.Errorf("failed to remove manifest: %w", err)
+	}
+	logger.Info("Done.")
+	return nil
+}
+
+// pruneEmptyParents removes dir and each of its parents that are empty, up to
+// but not including root. Directories that are not beneath root are left
+// alone, and those that no longer exist are skipped.
+func pruneEmptyParents(root, dir string) error {
+	for dir = filepath.Clean(dir); ; dir = filepath.Dir(dir) {
+		if rel, err := filepath.Rel(root, dir); err != nil || rel == "." || !filepath.IsLocal(rel) {
+			return nil
+		}
+		children, err := os.ReadDir(dir)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			continue
+		case err != nil:
+			return errs.Wrap(err)
+		case len(children) > 0:
+			return nil
+		}
+		if err := os.Remove(dir); err != nil {
+			return errs.Wrap(err)
+		}
+	}
+}
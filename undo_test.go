@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPruneEmptyParents(t *testing.T) {
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "dst")
+	for _, sub := range []string{"dst/a/b/c", "dst2/x"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := pruneEmptyParents(dst, filepath.Join(dst, "a", "b", "c")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "a")); !os.IsNotExist(err) {
+		t.Errorf("expected empty parents beneath the root to be removed (err=%v)", err)
+	}
+	if _, err := os.Stat(dst); err != nil {
+		t.Errorf("expected the root to be kept: %v", err)
+	}
+
+	// dst2 shares a prefix with dst but is not beneath it.
+	if err := pruneEmptyParents(dst, filepath.Join(dir, "dst2", "x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dst2", "x")); err != nil {
+		t.Errorf("expected a sibling of the root to be left alone: %v", err)
+	}
+}
+
+func TestPruneEmptyParentsRelativeRoot(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	chdir(t, dir)
+
+	if err := pruneEmptyParents(".", filepath.Join("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a")); !os.IsNotExist(err) {
+		t.Errorf("expected empty parents beneath . to be removed (err=%v)", err)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Errorf("expected the root to be kept: %v", err)
+	}
+}
+
+// chdir changes the working directory to dir until the test finishes.
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Error(err)
+		}
+	})
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+
+	"github.com/zeebo/errs"
+)
+
+// vendorImportPath returns the import path of dir within the module that
+// encloses it, for -vendor-mode.
+func vendorImportPath(dir string) (string, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", errs.Wrap(err)
+	}
+
+	modDir := absDir
+	for !fileExists(filepath.Join(modDir, "go.mod")) {
+		parent := filepath.Dir(modDir)
+		if parent == modDir {
+			return "", fmt.Errorf("destination %q is not within a module; use -dst-module to give its import path", dir)
+		}
+		modDir = parent
+	}
+
+	modulePath, err := getModulePath(modDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to get the path of the module enclosing the destination: %w", err)
+	}
+	rel, err := filepath.Rel(modDir, absDir)
+	if err != nil {
+		return "", errs.Wrap(err)
+	}
+	return path.Join(modulePath, filepath.ToSlash(rel)), nil
+}
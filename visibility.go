@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"go/parser"
+	"go/token"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// checkInternalVisibility ensures that no copied Go file imports, from the
+// destination of its package, a destination package that Go's internal rules
+// make invisible to it (e.g. a dependency at DstModule/internal/a importing
+// one at DstModule/internal/b/internal/c).
+func (w *Work) checkInternalVisibility() error {
+	paths := w.packagePaths()
+	violations := make(map[string]bool)
+	for _, src := range sortedKeys(w.GoFiles) {
+		pkg := w.packageForFile(src)
+		if pkg == nil {
+			continue
+		}
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return fmt.Errorf("failed to read source file %q: %w", src, err)
+		}
+		file, err := parser.ParseFile(token.NewFileSet(), src, data, parser.ImportsOnly)
+		if err != nil {
+			// Files that do not parse are reported when copied.
+			continue
+		}
+		for _, spec := range file.Imports {
+			importPath, _ := strconv.Unquote(spec.Path.Value)
+			dstImportPath, ok := paths[importPath]
+			if !ok {
+				continue
+			}
+			if !internalVisible(pkg.DstImportPath, dstImportPath) {
+				violations[fmt.Sprintf("%s (from %s) imports %s (from %s)", pkg.DstImportPath, pkg.SrcImportPath, dstImportPath, importPath)] = true
+			}
+		}
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("transplanted packages would import internal packages they cannot see:\n  %s", strings.Join(sortedKeys(violations), "\n  "))
+	}
+	return nil
+}
+
+// internalVisible reports whether the package at importer may import the
+// package at importee under Go's internal rules, where a package beneath an
+// internal element (the last, if more than one) may only be imported from
+// within the tree rooted at the parent of that element.
+func internalVisible(importer, importee string) bool {
+	var parent string
+	switch i := strings.LastIndex(importee, "/internal/"); {
+	case strings.HasSuffix(importee, "/internal"):
+		parent = path.Dir(importee)
+	case i >= 0:
+		parent = importee[:i]
+	default:
+		return true
+	}
+	return importer == parent || strings.HasPrefix(importer, parent+"/")
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// warn logs a warning with the given message and attributes, or, if strict is
+// set (via -strict), returns it as an error instead. Every warning about the
+// transplant itself goes through warn so that -strict can enforce a clean
+// run.
+func warn(strict bool, msg string, args ...any) error {
+	if !strict {
+		logger.Warn(msg, args...)
+		return nil
+	}
+
+	record := slog.NewRecord(time.Time{}, slog.LevelWarn, msg, 0)
+	record.Add(args...)
+	parts := []string{msg}
+	record.Attrs(func(attr slog.Attr) bool {
+		parts = append(parts, attr.String())
+		return true
+	})
+	return errors.New(strings.Join(parts, " "))
+}
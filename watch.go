@@ -0,0 +1,140 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+)
+
+const (
+	// watchPollInterval is how often the source is checked for changes.
+	watchPollInterval = 500 * time.Millisecond
+
+	// watchSettleTime is how long the source must go unchanged after a
+	// change before the transplant is re-run, so that a burst of saves
+	// triggers a single run.
+	watchSettleTime = 300 * time.Millisecond
+)
+
+// watch transplants the source and then re-runs the transplant each time the
+// source changes, until interrupted. Changes are detected by polling the
+// source directories of the transplanted packages along with the copied
+// files and the source go.mod and go.sum. Failed runs are logged and the
+// source is watched for a fix.
+func watch(dstDir, srcDir string, opts *Options) error {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+
+	// Until a plan exists, fall back to the source directory itself.
+	watched := []string{srcDir}
+	for {
+		// The snapshot is taken before transplanting so that changes made
+		// while the transplant runs are not missed.
+		previous := watched
+		before := snapshotPaths(previous)
+		work, err := transplant(dstDir, srcDir, opts)
+		if err != nil {
+			logger.Error("Transplant failed; waiting for source changes", "err", err)
+		}
+		if work != nil {
+			if paths := watchedPaths(work); len(paths) > 0 {
+				watched = paths
+			}
+		}
+
+		logger.Info("Watching source for changes...")
+		current := snapshotPaths(previous)
+		changed := !snapshotsEqual(before, current)
+		if !slices.Equal(previous, watched) {
+			// Paths the new plan watches are only compared from here on.
+			current = snapshotPaths(watched)
+		}
+		for !changed {
+			select {
+			case <-interrupt:
+				logger.Info("Stopped watching.")
+				return nil
+			case <-time.After(watchPollInterval):
+			}
+			changed = !snapshotsEqual(current, snapshotPaths(watched))
+		}
+
+		// Wait for the source to settle.
+		for settled := snapshotPaths(watched); ; {
+			select {
+			case <-interrupt:
+				logger.Info("Stopped watching.")
+				return nil
+			case <-time.After(watchSettleTime):
+			}
+			next := snapshotPaths(watched)
+			if snapshotsEqual(settled, next) {
+				break
+			}
+			settled = next
+		}
+		logger.Info("Source changed; transplanting again...")
+	}
+}
+
+// watchedPaths returns the paths watched for changes to the work's source:
+// the directories of the transplanted packages (so added files are noticed),
+// every copied file, and the source go.mod and go.sum.
+func watchedPaths(work *Work) []string {
+	paths := []string{work.SrcGoMod, filepath.Join(filepath.Dir(work.SrcGoMod), "go.sum")}
+	for _, pkg := range work.Packages {
+		paths = append(paths, pkg.SrcDir)
+	}
+	paths = append(paths, sortedKeys(work.GoFiles)...)
+	paths = append(paths, sortedKeys(work.OtherFiles)...)
+	return paths
+}
+
+type pathState struct {
+	size    int64
+	modTime time.Time
+	mode    os.FileMode
+}
+
+// snapshotPaths records the state of each path and, for directories, of each
+// of their entries. Missing paths are recorded as absent.
+func snapshotPaths(paths []string) map[string]pathState {
+	snapshot := make(map[string]pathState)
+	record := func(path string) os.FileInfo {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil
+		}
+		snapshot[path] = pathState{size: info.Size(), modTime: info.ModTime(), mode: info.Mode()}
+		return info
+	}
+	for _, path := range paths {
+		if info := record(path); info == nil || !info.IsDir() {
+			continue
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			record(filepath.Join(path, entry.Name()))
+		}
+	}
+	return snapshot
+}
+
+func snapshotsEqual(a, b map[string]pathState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, state := range a {
+		if other, ok := b[path]; !ok || other != state {
+			return false
+		}
+	}
+	return true
+}